@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/mholt/acmez/acme"
+)
+
+// configureACME sets up which ACME CA certmagic requests certificates from
+func configureACME(c Config) (err error) {
+	certmagic.DefaultACME.Agreed = true
+	certmagic.DefaultACME.Email = c.LetsEncryptEmail
+
+	directory := c.ACMEDirectory
+	if directory == "" {
+		directory = certmagic.LetsEncryptProductionCA
+	}
+
+	if c.ACMEStaging {
+		if directory != certmagic.LetsEncryptProductionCA {
+			return errors.New("staging can only be used with the default CA, give the staging directory URL of your CA instead")
+		}
+		directory = certmagic.LetsEncryptStagingCA
+	}
+
+	u, err := url.Parse(directory)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid ACME directory URL %q, it must start with https://", directory)
+	}
+
+	if directory != certmagic.LetsEncryptProductionCA {
+		log.Println("Requesting certificates from ACME directory", directory)
+
+		// Failed attempts are retried against the Let's Encrypt staging CA by default, which makes no sense for other CAs
+		certmagic.DefaultACME.TestCA = ""
+	}
+	certmagic.DefaultACME.CA = directory
+
+	// CAs like ZeroSSL only issue certificates for accounts that are bound to an account on their website
+	if c.ACMEEABKeyID != "" || c.ACMEEABMACKey != "" {
+		if c.ACMEEABKeyID == "" || c.ACMEEABMACKey == "" {
+			return errors.New("both key ID and MAC key are needed for external account binding")
+		}
+
+		certmagic.DefaultACME.ExternalAccount = &acme.EAB{
+			KeyID:  c.ACMEEABKeyID,
+			MACKey: c.ACMEEABMACKey,
+		}
+	}
+
+	// Test servers like Pebble use their own certificate for the ACME API
+	if c.ACMETrustedRoot != "" {
+		certmagic.DefaultACME.TrustedRoots, err = loadCertPool(c.ACMETrustedRoot)
+		if err != nil {
+			return fmt.Errorf("loading trusted root for ACME server: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// loadCertPool returns the system certificate pool with all certificates from the given PEM file added
+func loadCertPool(pemFile string) (pool *x509.CertPool, err error) {
+	content, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return
+	}
+
+	pool, err = x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificates found in %q", pemFile)
+	}
+
+	return pool, nil
+}
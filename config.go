@@ -4,10 +4,16 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
 )
 
 type Config struct {
@@ -15,10 +21,90 @@ type Config struct {
 	SecurePort                int    `json:"secure_port"`
 	BaseDir                   string `json:"dir"`
 	DisallowDirectoryListings bool   `json:"disallow_listings"`
+	AllowUploads              bool   `json:"allow_uploads"`
+	WebDAV                    bool   `json:"webdav"`
+	TemplateFile              string `json:"template"`
+	AssetsDir                 string `json:"assets"`
+
+	// SessionLifetime is how long users stay logged in after using the login form
+	SessionLifetime Duration `json:"session_lifetime"`
+
+	DuckDNSToken     string   `json:"duck_dns_token"`
+	DuckDNSSites     []string `json:"duck_dns_sites"`
+	LetsEncryptEmail string   `json:"lets_encrypt_email"`
+
+	// DNSProvider selects how DNS records of our domains are updated, "duckdns" (default) or "rfc2136"
+	DNSProvider string `json:"dns_provider,omitempty"`
+	// Domains are the domain names for the rfc2136 provider, DuckDNS uses DuckDNSSites instead
+	Domains       []string `json:"domains,omitempty"`
+	RFC2136Server string   `json:"rfc2136_server,omitempty"`
+	RFC2136Zone   string   `json:"rfc2136_zone,omitempty"`
+	TSIGKeyName   string   `json:"tsig_key,omitempty"`
+	TSIGSecret    string   `json:"tsig_secret,omitempty"`
+	TSIGAlgorithm string   `json:"tsig_algorithm,omitempty"`
+	// IPLookupURL returns our public IPv4 address for providers that cannot detect it themselves
+	IPLookupURL string `json:"ip_lookup_url,omitempty"`
+
+	// ACMEDirectory is the ACME CA certificates are requested from, default is Let's Encrypt
+	ACMEDirectory string `json:"acme_ca,omitempty"`
+	ACMEStaging   bool   `json:"acme_staging,omitempty"`
+	// ACMEEABKeyID and ACMEEABMACKey are used for external account binding, which some CAs like ZeroSSL require
+	ACMEEABKeyID  string `json:"acme_eab_key_id,omitempty"`
+	ACMEEABMACKey string `json:"acme_eab_mac_key,omitempty"`
+	// ACMETrustedRoot is a PEM file with the certificate of the ACME server, e.g. for testing with Pebble
+	ACMETrustedRoot string `json:"acme_trusted_root,omitempty"`
+
+	// CertFile and KeyFile are PEM files that are used for HTTPS instead of getting a certificate for DuckDNS
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// RedirectHTTPS makes the HTTP server redirect requests from outside the local network to the HTTPS server,
+	// which is reachable on ExternalPort from the internet. If ExternalPort is zero, SecurePort is used
+	RedirectHTTPS bool `json:"redirect_https"`
+	ExternalPort  int  `json:"external_port,omitempty"`
+	// HSTS is the Strict-Transport-Security policy sent by the HTTPS server, empty disables the header
+	HSTS string `json:"hsts"`
+
+	// ClientAuth is "optional" or "require" if HTTPS servers should log in users with client certificates signed by
+	// the CA in ClientCAFile, or the local CA if it is empty
+	ClientAuth   string `json:"client_auth,omitempty"`
+	ClientCAFile string `json:"client_ca,omitempty"`
+
+	// LANHTTPS enables a HTTPS server with certificates from a local CA, it listens on LANSecurePort
+	LANHTTPS      bool `json:"lan_https"`
+	LANSecurePort int  `json:"lan_secure_port"`
+
+	UpdateInterval   Duration `json:"update_interval"`
+	DuckDNSUpdateURL string   `json:"duck_dns_update_url"`
 
-	DuckDNSToken     string `json:"duck_dns_token"`
-	DuckDNSSite      string `json:"duck_dns_site"`
-	LetsEncryptEmail string `json:"lets_encrypt_email"`
+	// Hosts maps host names to other directories, requests for all other hosts are served from BaseDir
+	Hosts map[string]HostConfig `json:"hosts,omitempty"`
+
+	// Subdomains maps subdomains of all DuckDNS sites to directories, e.g. "photos" => "Pictures" serves
+	// photos.mysite.duckdns.org from the Pictures directory. Relative paths are in BaseDir
+	Subdomains map[string]string `json:"subdomains,omitempty"`
+
+	// LegacyDuckDNSSite is only read from config files of older versions that supported only one site
+	LegacyDuckDNSSite string `json:"duck_dns_site,omitempty"`
+}
+
+// Duration is a time.Duration that is saved as a string like "5m0s" in the config file
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return
+	}
+
+	td, err := time.ParseDuration(s)
+	*d = Duration(td)
+	return
 }
 
 var (
@@ -26,10 +112,42 @@ var (
 	securePort                = flag.Int("sp", 443, "HTTPS server port")
 	baseDir                   = flag.String("dir", ".", "Directory that should be served")
 	disallowDirectoryListings = flag.Bool("disallow-listings", false, "Disable directory listings and downloads")
+	allowUploads              = flag.Bool("upload", false, "Allow uploading files using PUT requests or the form in directory listings")
+	webDAV                    = flag.Bool("webdav", false, "Allow mounting the directory as a network drive using WebDAV. This allows clients to modify files")
+	templateFile              = flag.String("template", "", "Path to an HTML template file that should be used for directory listings instead of the built-in one")
+	assetsDir                 = flag.String("assets", "", "Directory with static files for the template (e.g. CSS and icons), they are served publicly under "+assetsPrefix)
+
+	sessionLifetime = flag.Duration("session-lifetime", defaultSessionLifetime, "How long users stay logged in after using the login form in their browser")
 
 	letsEncryptEmail = flag.String("email", "", "Email sent to LetsEncrypt for certificate registration")
 	duckDNSToken     = flag.String("token", "", "The token you get from duckdns.org")
-	duckDNSSite      = flag.String("site", "", "Your duckdns.org subdomain name, e.g. \"test\" for test.duckdns.org")
+	duckDNSSite      = flag.String("site", "", "Your duckdns.org subdomain name, e.g. \"test\" for test.duckdns.org. Multiple sites can be separated by commas")
+	certFile         = flag.String("cert", "", "Certificate file (PEM) for the HTTPS server, instead of getting one from LetsEncrypt. It is reloaded when it changes")
+	keyFile          = flag.String("key", "", "Private key file (PEM) for the certificate given with -cert")
+	dnsProvider      = flag.String("dns-provider", "duckdns", "How the DNS records of your domains are updated, \"duckdns\" or \"rfc2136\" for dynamic updates on your own DNS server")
+	domainList       = flag.String("domain", "", "Your domain names for the rfc2136 DNS provider, separated by commas")
+	rfc2136Server    = flag.String("rfc2136-server", "", "Address of the authoritative DNS server that accepts dynamic updates, e.g. \"ns1.example.com:53\"")
+	rfc2136Zone      = flag.String("rfc2136-zone", "", "DNS zone that contains your domains, e.g. \"example.com\"")
+	tsigKeyName      = flag.String("tsig-key", "", "Name of the TSIG key for signing dynamic updates")
+	tsigSecret       = flag.String("tsig-secret", "", "Base64-encoded secret of the TSIG key")
+	tsigAlgorithm    = flag.String("tsig-algorithm", defaultTSIGAlgorithm, "Algorithm of the TSIG key")
+	ipLookupURL      = flag.String("ip-url", "https://api.ipify.org", "URL that returns your public IPv4 address, used by the rfc2136 DNS provider. If empty, your local address is used")
+	acmeDirectory    = flag.String("acme-ca", certmagic.LetsEncryptProductionCA, "Directory URL of the ACME CA certificates are requested from")
+	acmeStaging      = flag.Bool("acme-staging", false, "Request certificates from the Let's Encrypt staging CA, which has higher rate limits but issues untrusted certificates. Useful for testing")
+	acmeEABKeyID     = flag.String("eab-kid", "", "Key ID for external account binding, required by some CAs like ZeroSSL")
+	acmeEABMACKey    = flag.String("eab-hmac", "", "Base64url-encoded MAC key for external account binding")
+	acmeTrustedRoot  = flag.String("acme-root", "", "PEM file with a root certificate that is trusted for connecting to the ACME CA, e.g. for a local Pebble test server")
+	redirectHTTPS    = flag.Bool("redirect", false, "Redirect HTTP requests from outside your local network to the HTTPS server")
+	externalPort     = flag.Int("external-port", 0, "Port your router forwards to the HTTPS server, it is used for redirects and share links. Default is the port set with -sp")
+	hstsPolicy       = flag.String("hsts", "", "Strict-Transport-Security policy sent by the HTTPS server, e.g. \"max-age=31536000\", which makes browsers only use HTTPS for your domain. Default is no policy")
+	clientAuthMode   = flag.String("client-auth", "off", "Log in users with client certificates on HTTPS servers, \"optional\" also allows passwords and \"require\" rejects connections without certificate")
+	clientCAFile     = flag.String("client-ca", "", "PEM file with the CA that signs client certificates. Default is the local CA, see \"upduck clientcert\"")
+	lanHTTPS         = flag.Bool("lan-https", false, "Start a HTTPS server for the local network with a certificate from a local CA, which can be exported with \"upduck exportca\"")
+	lanSecurePort    = flag.Int("lan-sp", 8443, "Port of the HTTPS server for the local network started with -lan-https")
+	updateInterval   = flag.Duration("update-interval", 5*time.Minute, "How often your IP address is sent to DuckDNS, 0 to only send it at startup and when the network changes")
+	duckDNSUpdateURL = flag.String("duckdns-url", defaultUpdateURL, "URL of the DuckDNS update API, only useful for testing")
+
+	subdomains stringList
 
 	save = flag.Bool("save", false, "Save the given command line arguments to a config file located in your home directory")
 )
@@ -37,8 +155,19 @@ var (
 const (
 	configFileName = ".upduck.json"
 	userFileName   = ".users.upduck.json"
+
+	shareKeyFileName  = ".share.upduck.key"
+	downloadsFileName = ".downloads.upduck.json"
+	lockoutsFileName  = ".lockouts.upduck.json"
+
+	caCertFileName = ".ca.upduck.pem"
+	caKeyFileName  = ".ca.upduck.key"
 )
 
+func init() {
+	flag.Var(&subdomains, "subdomain", "Serve a directory on a subdomain of your DuckDNS site, e.g. \"photos=Pictures\" for photos.mysite.duckdns.org. Can be given multiple times")
+}
+
 func usage() {
 	fmt.Fprint(flag.CommandLine.Output(), "upduck, a simple HTTP and HTTPS file server\n\n")
 	fmt.Fprintln(flag.CommandLine.Output(), "Command-line flags:")
@@ -58,6 +187,27 @@ Examples:
 
 		upduck -dir path/to/dir
 
+	Allow uploading files into the served directory:
+
+		> upduck -upload
+
+		Files can then be uploaded using the form in directory listings or with a PUT request, e.g. "curl -T file.txt http://host:8080/file.txt".
+
+	Allow mounting the served directory as a network drive using WebDAV:
+
+		> upduck -webdav
+
+		Your file manager can then connect to the server address, e.g. "dav://host:8080/" or "\\host@8080\DavWWWRoot" on Windows.
+		Please note that WebDAV clients can create, modify and delete files.
+		Together with -disallow-listings, WebDAV clients can't list directories either, so most file managers can only open files with a known path.
+
+	Use your own template for directory listings, with stylesheets and icons from a directory:
+
+		> upduck -template listing.html -assets path/to/assets
+
+		The template is a Go html/template file, see the README for available data. Files from the assets directory can be referenced with {{asset "style.css"}}.
+		If the template cannot be loaded, the built-in one is used.
+
 	Start a HTTP server and a HTTPS server:
 
 		> upduck -email your@email.com -token DuckDNSToken -site mysite
@@ -66,12 +216,66 @@ Examples:
 		This external chosen port you set in the router must be put after the DuckDNS URL, e.g. https://mysite.duckdns.org:525/ for port 525.
 		If you're not sure about how this works, search for "port forward tutorial" and your router model/vendor.
 
+	A HTTPS server can also answer on multiple DuckDNS domains, they are all updated with your IP address and get a certificate:
+
+		> upduck -email your@email.com -token DuckDNSToken -site mysite,othersite
+
+	Serve subdirectories on subdomains of your DuckDNS site, e.g. photos.mysite.duckdns.org. This requests a wildcard certificate:
+
+		> upduck -email your@email.com -token DuckDNSToken -site mysite -subdomain photos=Pictures -subdomain docs=Documents
+
+	Start a HTTPS server with your own certificate, e.g. from your internal CA or another ACME client:
+
+		> upduck -cert cert.pem -key key.pem
+
+		The files are reloaded automatically when they change, so you can renew the certificate without restarting.
+
+	Encrypt transfers in your local network without DuckDNS, using a certificate from a local CA that is created on the first start:
+
+		> upduck -lan-https
+
+		The HTTPS server listens on port 8443 (change it with -lan-sp), e.g. https://192.168.1.2:8443/.
+		Browsers will warn about the certificate until you install the CA on your devices, see "Local CA" below.
+
 	Start a HTTP server and a HTTPS server on custom ports:
 
 		> upduck -p 2020 -sp 2121 -email your@email.com -token DuckDNSToken -site mysite
 
 		Here, the above notice also applies - ports (in this case 2121) must be forwarded in your router.
 
+	Redirect visitors from the internet to the HTTPS server, while devices in your local network can still use HTTP:
+
+		> upduck -redirect -external-port 525 -email your@email.com -token DuckDNSToken -site mysite
+
+		The external port is the one you forward in your router, requests are then redirected to e.g. https://mysite.duckdns.org:525/.
+		Once everything works, -hsts "max-age=31536000" tells browsers to always use HTTPS for your domain.
+
+	Log in with client certificates instead of passwords on all HTTPS servers (see "Local CA" below for creating them):
+
+		> upduck -client-auth optional -email your@email.com -token DuckDNSToken -site mysite
+
+		With "optional", users without certificate can still log in with their password. "require" rejects all HTTPS connections without a valid certificate.
+
+	Use your own domain with a DNS server that supports dynamic updates (RFC 2136), e.g. BIND or Knot:
+
+		> upduck -email your@email.com -dns-provider rfc2136 -domain home.example.com -rfc2136-server ns1.example.com -rfc2136-zone example.com -tsig-key upduck -tsig-secret Base64Secret
+
+		The A and AAAA records of your domains are kept up to date like with DuckDNS, and certificates are requested using TXT records.
+
+	Test your setup against the Let's Encrypt staging CA to avoid hitting rate limits. Its certificates are not trusted by browsers:
+
+		> upduck -acme-staging -email your@email.com -token DuckDNSToken -site mysite
+
+	Get certificates from another ACME CA, e.g. ZeroSSL with the external account binding credentials from their website:
+
+		> upduck -acme-ca https://acme.zerossl.com/v2/DV90 -eab-kid KeyID -eab-hmac MACKey -email your@email.com -token DuckDNSToken -site mysite
+
+		For a local test CA like Pebble, also give its root certificate with -acme-root pebble.minica.pem.
+
+	Your IP address is sent to DuckDNS at startup, every 5 minutes and whenever the network addresses of your device change. You can change the interval:
+
+		> upduck -update-interval 30m -email your@email.com -token DuckDNSToken -site mysite
+
 	You can also save your configuration so you don't need to type out everything all the time. Just run it normal and add the -save flag:
 
 		> upduck -save -p 2020 -email your@email.com -token DuckDNSToken -site mysite
@@ -86,6 +290,12 @@ User configuration:
 
 		> upduck adduser <username> <password>
 
+	Users can be restricted to certain directories (-path can be given multiple times) and roles:
+
+		> upduck adduser <username> <password> -role read -path /projects/a
+
+		The role "read" only allows downloading files, "upload" additionally allows uploading files and "admin" (default) can also delete and move files.
+
 	Delete a user:
 
 		> upduck deluser <username>
@@ -94,7 +304,64 @@ User configuration:
 
 		> upduck resetusers
 
-	If any user accounts are configured, you need to log in before accessing files.`, "\t", "  "))
+	If any user accounts are configured, you need to log in before accessing files.
+	Browsers show a login form, you then stay logged in for a week (change it with -session-lifetime 12h) or until you log out.
+	Other programs like curl can still use basic auth, e.g. "curl -u username:password http://host:8080/file.txt".
+
+	All user commands accept the -users option for managing the separate user file of a virtual host (see README):
+
+		> upduck adduser <username> <password> -users .users.example.json
+
+Share links:
+	You can send a link to a file or directory to someone who doesn't have an account. The path is relative to the served directory.
+
+		> upduck share <path> [-expires 24h] [-downloads 1] [-url https://mysite.duckdns.org:525]
+
+		The link only allows downloading the given file or anything in the given directory until it expires.
+		With the -downloads option, the link stops working after that many downloads. Directory listings don't count as download, but any file or archive download does.
+		Links for a virtual host or subdomain must be created with -host, e.g. "-host photos.mysite.duckdns.org"; the path is then relative to its directory.
+
+Local CA:
+	The local CA used by -lan-https is stored in your config directory. Export its certificate for installing it on your devices:
+
+		> upduck exportca [file]
+
+		Without a file, the certificate is written to the terminal. Never share the private key file next to it.
+
+	The local CA can also issue client certificates, which log in a user without password on HTTPS servers started with -client-auth:
+
+		> upduck clientcert <username> [-valid 8760h] [-out name]
+
+		This creates name.pem and name.key (default name is the username). The certificate only works for this user in this user file, deleting the user makes it useless.
+		Certificates from your own CA (see -client-ca) must be added with -import cert.pem.
+
+	Show the client certificates of a user, or revoke one of them or all:
+
+		> upduck revokecert <username> [fingerprint] [-all]
+
+Two-factor authentication:
+	Require a code from an authenticator app like Aegis or Google Authenticator in addition to the password of a user:
+
+		> upduck totp <username> [-issuer mysite]
+
+		This prints an otpauth:// URI for the app, which can be shown as QR code with "qrencode -t ansiutf8 '<uri>'".
+		The user must then enter the current code on the login form. Basic auth is disabled for the user, client certificates still work.
+
+	Remove two-factor authentication from a user:
+
+		> upduck totp <username> -disable
+
+Failed logins:
+	After a failed login, the IP address and the user must wait before trying again. The delay doubles with every failure, up to 30 seconds.
+	10 failures within an hour lock them out for 15 minutes. Show who is currently locked out or delayed:
+
+		> upduck lockouts
+
+	Allow an IP address or user to log in again, or everyone if no argument is given:
+
+		> upduck unlock [ip or username]
+
+		Failed logins are logged like [Auth] Failed login for user "name" from 203.0.113.7, which tools like fail2ban can use to block addresses in your firewall.`, "\t", "  "))
 }
 
 // ParseConfig parses command-line flags
@@ -105,11 +372,41 @@ func ParseConfig() (c Config, ustore *UserStore, err error) {
 	c = Config{
 		ServerPort:                *serverPort,
 		DuckDNSToken:              *duckDNSToken,
-		DuckDNSSite:               *duckDNSSite,
+		DuckDNSSites:              parseSiteList(*duckDNSSite),
 		LetsEncryptEmail:          *letsEncryptEmail,
 		DisallowDirectoryListings: *disallowDirectoryListings,
+		AllowUploads:              *allowUploads,
+		WebDAV:                    *webDAV,
+		TemplateFile:              *templateFile,
+		AssetsDir:                 *assetsDir,
+		SessionLifetime:           Duration(*sessionLifetime),
 		BaseDir:                   *baseDir,
 		SecurePort:                *securePort,
+		UpdateInterval:            Duration(*updateInterval),
+		DuckDNSUpdateURL:          *duckDNSUpdateURL,
+		Subdomains:                parseSubdomains(subdomains),
+		CertFile:                  *certFile,
+		KeyFile:                   *keyFile,
+		DNSProvider:               strings.ToLower(*dnsProvider),
+		Domains:                   parseDomainList(*domainList),
+		RFC2136Server:             *rfc2136Server,
+		RFC2136Zone:               *rfc2136Zone,
+		TSIGKeyName:               *tsigKeyName,
+		TSIGSecret:                *tsigSecret,
+		TSIGAlgorithm:             *tsigAlgorithm,
+		IPLookupURL:               *ipLookupURL,
+		ACMEDirectory:             *acmeDirectory,
+		ACMEStaging:               *acmeStaging,
+		ACMEEABKeyID:              *acmeEABKeyID,
+		ACMEEABMACKey:             *acmeEABMACKey,
+		ACMETrustedRoot:           *acmeTrustedRoot,
+		RedirectHTTPS:             *redirectHTTPS,
+		ExternalPort:              *externalPort,
+		HSTS:                      *hstsPolicy,
+		ClientAuth:                strings.ToLower(*clientAuthMode),
+		ClientCAFile:              *clientCAFile,
+		LANHTTPS:                  *lanHTTPS,
+		LANSecurePort:             *lanSecurePort,
 	}
 
 	upath := getConfigPath(userFileName)
@@ -128,10 +425,28 @@ func ParseConfig() (c Config, ustore *UserStore, err error) {
 	// Examples:
 	// Add user:
 	//     upduck adduser myname mypassword
+	// Add user that can only read files in a certain directory:
+	//     upduck adduser myname mypassword -role read -path /projects/a
+	// Add user to the separate user file of a virtual host:
+	//     upduck adduser myname mypassword -users .users.example.json
 	// Remove user:
 	//     upduck deluser myname
 	// Remove all users:
 	//     upduck resetusers
+	// Create a share link:
+	//     upduck share path/to/file.pdf -expires 48h
+	// Export the certificate of the local CA:
+	//     upduck exportca upduck-ca.pem
+	// Create a client certificate for a user:
+	//     upduck clientcert myname -valid 8760h
+	// Revoke all client certificates of a user:
+	//     upduck revokecert myname -all
+	// Enable two-factor authentication for a user:
+	//     upduck totp myname
+	// Show IP addresses and users that can't log in because of failed logins:
+	//     upduck lockouts
+	// Allow an IP address or user to log in again, or everyone without argument:
+	//     upduck unlock 203.0.113.7
 	if flag.NFlag() == 0 && flag.NArg() > 0 {
 		switch strings.ToLower(flag.Arg(0)) {
 		case "adduser", "useradd", "createuser", "replaceuser":
@@ -143,9 +458,34 @@ func ParseConfig() (c Config, ustore *UserStore, err error) {
 				log.Fatalln("Password must be given")
 			}
 
-			// Add (or replace) that user in the user store
+			var (
+				userFlags = flag.NewFlagSet("adduser", flag.ExitOnError)
+				role      = userFlags.String("role", roleAdmin, "Role of the user, one of \"read\", \"upload\" or \"admin\"")
+				users     = userFlags.String("users", "", "User file of a virtual host, default is the normal user file")
+				paths     stringList
+			)
+			userFlags.Var(&paths, "path", "Directory the user can access, can be given multiple times. Default is everything")
+			userFlags.Parse(flag.Args()[3:])
+			ustore = selectUserStore(ustore, *users)
+
+			if !isValidRole(*role) {
+				log.Fatalf("Unknown role %q, must be one of \"read\", \"upload\" or \"admin\"\n", *role)
+			}
+
+			pwHash, err := hashPassword(passwd)
+			if err != nil {
+				log.Fatalln("Error while hashing password:", err.Error())
+			}
+
+			// Add (or replace) that user in the user store. Changing the password keeps two-factor authentication
+			// and client certificates
 			ustore.Users[uname] = user{
-				PasswordHash: hash(passwd),
+				PasswordHash: pwHash,
+				Role:         *role,
+				Paths:        paths,
+				TOTPSecret:   ustore.Users[uname].TOTPSecret,
+				TOTPStep:     ustore.Users[uname].TOTPStep,
+				Certificates: ustore.Users[uname].Certificates,
 			}
 
 			err = ustore.Save()
@@ -160,6 +500,11 @@ func ParseConfig() (c Config, ustore *UserStore, err error) {
 				log.Fatalln("Username must be given to delete it")
 			}
 
+			userFlags := flag.NewFlagSet("deluser", flag.ExitOnError)
+			users := userFlags.String("users", "", "User file of a virtual host, default is the normal user file")
+			userFlags.Parse(flag.Args()[2:])
+			ustore = selectUserStore(ustore, *users)
+
 			// Remove user from the user store
 			delete(ustore.Users, uname)
 
@@ -170,6 +515,11 @@ func ParseConfig() (c Config, ustore *UserStore, err error) {
 			log.Println("Successfully removed user")
 			os.Exit(0)
 		case "delallusers", "rmallusers", "resetusers":
+			userFlags := flag.NewFlagSet("resetusers", flag.ExitOnError)
+			users := userFlags.String("users", "", "User file of a virtual host, default is the normal user file")
+			userFlags.Parse(flag.Args()[1:])
+			ustore = selectUserStore(ustore, *users)
+
 			ustore.Users = make(map[string]user)
 
 			err = ustore.Save()
@@ -178,6 +528,309 @@ func ParseConfig() (c Config, ustore *UserStore, err error) {
 			}
 			log.Println("Successfully removed user data")
 			os.Exit(0)
+		case "share":
+			sharePath := flag.Arg(1)
+			if sharePath == "" {
+				log.Fatalln("Path of the shared file or directory must be given")
+			}
+
+			var (
+				shareFlags = flag.NewFlagSet("share", flag.ExitOnError)
+				expires    = shareFlags.Duration("expires", 24*time.Hour, "How long the link should be valid")
+				downloads  = shareFlags.Int("downloads", 0, "How many downloads the link can be used for, e.g. 1 for a one-time link. Default is unlimited")
+				baseURL    = shareFlags.String("url", "", "Server URL the link should point to, e.g. \"https://mysite.duckdns.org:525\". Default is guessed from your configuration")
+				host       = shareFlags.String("host", "", "Virtual host or subdomain the link is for, e.g. \"photos.mysite.duckdns.org\". Default is the main directory")
+			)
+			shareFlags.Parse(flag.Args()[2:])
+
+			if *expires <= 0 {
+				log.Fatalln("Expiry duration must be positive")
+			}
+			if *downloads < 0 {
+				log.Fatalln("Number of downloads must not be negative")
+			}
+
+			// The saved configuration tells us which directory is served and how to reach the server
+			err = loadConfigFile(getConfigPath(configFileName), &c)
+			if err != nil && !os.IsNotExist(err) {
+				log.Fatalln("Error while loading config file:", err.Error())
+			}
+
+			key, err := loadSigningKey(getConfigPath(shareKeyFileName))
+			if err != nil {
+				log.Fatalln("Error while loading key for share links:", err.Error())
+			}
+
+			// Every virtual host has its own key, so the link only works on the host it was created for
+			dir := c.BaseDir
+			if *host != "" {
+				dir, err = hostDir(c, *host)
+				if err != nil {
+					log.Fatalln("Error while selecting host:", err.Error())
+				}
+
+				abs, err := filepath.Abs(dir)
+				if err != nil {
+					log.Fatalln("Error while selecting host:", err.Error())
+				}
+				key = hostSigningKey(key, abs)
+			}
+
+			link, err := newShareLink(key, filepath.ToSlash(sharePath), *expires, *downloads)
+			if err != nil {
+				log.Fatalln("Error while creating share link:", err.Error())
+			}
+
+			// Directory links must end with a slash, else the links in listings don't work
+			var isDir bool
+			fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(link.Path)))
+			if err != nil {
+				log.Printf("[Warning] %q doesn't exist in %q\n", link.Path, dir)
+			} else {
+				isDir = fi.IsDir()
+			}
+
+			if *baseURL == "" {
+				*baseURL = guessBaseURL(c)
+
+				// The guessed URL has the right scheme and port, but the host name of the main directory
+				if u, err := url.Parse(*baseURL); err == nil && *host != "" {
+					if port := u.Port(); port != "" {
+						u.Host = net.JoinHostPort(normalizeHost(*host), port)
+					} else {
+						u.Host = normalizeHost(*host)
+					}
+					*baseURL = u.String()
+				}
+			}
+
+			fmt.Println(link.URL(*baseURL, isDir))
+			log.Println("This link is valid until", link.Expires.Format(time.RFC1123))
+			if link.MaxDownloads > 0 {
+				log.Printf("It can be used for %d download(s), archive downloads of directories also count\n", link.MaxDownloads)
+			}
+			os.Exit(0)
+		case "exportca":
+			ca, err := loadOrCreateLocalCA(getConfigPath(caCertFileName), getConfigPath(caKeyFileName))
+			if err != nil {
+				log.Fatalln("Error while loading local CA:", err.Error())
+			}
+
+			outFile := flag.Arg(1)
+			if outFile == "" {
+				os.Stdout.Write(ca.CertPEM)
+				os.Exit(0)
+			}
+
+			err = ioutil.WriteFile(outFile, ca.CertPEM, 0644)
+			if err != nil {
+				log.Fatalln("Error while exporting CA certificate:", err.Error())
+			}
+			log.Println("Exported CA certificate to", outFile, "- install it on your devices to trust the LAN HTTPS server")
+			os.Exit(0)
+		case "clientcert":
+			uname := flag.Arg(1)
+			if uname == "" {
+				log.Fatalln("Username must be given")
+			}
+
+			var (
+				certFlags  = flag.NewFlagSet("clientcert", flag.ExitOnError)
+				valid      = certFlags.Duration("valid", 365*24*time.Hour, "How long the certificate should be valid")
+				out        = certFlags.String("out", uname, "File name prefix for the certificate and key file")
+				importFile = certFlags.String("import", "", "PEM file with a certificate from your own CA (see -client-ca) that should be added instead of creating one")
+				users      = certFlags.String("users", "", "User file of a virtual host, default is the normal user file")
+			)
+			certFlags.Parse(flag.Args()[2:])
+			ustore = selectUserStore(ustore, *users)
+
+			usr, ok := ustore.Users[uname]
+			if !ok {
+				log.Fatalf("User %q doesn't exist, create it with \"upduck adduser\" first\n", uname)
+			}
+
+			if *importFile != "" {
+				leaf, err := loadCertificateFile(*importFile)
+				if err != nil {
+					log.Fatalln("Error while loading certificate:", err.Error())
+				}
+				if leaf.Subject.CommonName != uname {
+					log.Fatalf("The common name of the certificate is %q, but it must be the user name %q\n", leaf.Subject.CommonName, uname)
+				}
+
+				usr.addCertificate(leaf)
+				ustore.Users[uname] = usr
+
+				err = ustore.Save()
+				if err != nil {
+					log.Fatalln("Error while saving user data:", err.Error())
+				}
+
+				log.Printf("Added certificate %s to user %s\n", certFingerprint(leaf), uname)
+				os.Exit(0)
+			}
+
+			if *valid <= 0 {
+				log.Fatalln("Validity duration must be positive")
+			}
+
+			ca, err := loadOrCreateLocalCA(getConfigPath(caCertFileName), getConfigPath(caKeyFileName))
+			if err != nil {
+				log.Fatalln("Error while loading local CA:", err.Error())
+			}
+
+			cert, err := ca.issueClientCert(uname, *valid)
+			if err != nil {
+				log.Fatalln("Error while creating client certificate:", err.Error())
+			}
+
+			certPath, keyPath := *out+".pem", *out+".key"
+			err = writeCertFiles(cert, certPath, keyPath)
+			if err != nil {
+				log.Fatalln("Error while saving client certificate:", err.Error())
+			}
+
+			// The certificate only works for the user in this user file
+			usr.addCertificate(cert.Leaf)
+			ustore.Users[uname] = usr
+
+			err = ustore.Save()
+			if err != nil {
+				log.Fatalln("Error while saving user data:", err.Error())
+			}
+
+			log.Printf("Saved client certificate for %s to %s and %s, it is valid until %s\n", uname, certPath, keyPath, cert.Leaf.NotAfter.Format(time.RFC1123))
+			log.Printf("Its fingerprint is %s, which can be used for revoking it with \"upduck revokecert\"\n", certFingerprint(cert.Leaf))
+			log.Printf("Browsers need a PKCS#12 file, which can be created with \"openssl pkcs12 -export -in %s -inkey %s -out %s.p12\"\n", certPath, keyPath, *out)
+			os.Exit(0)
+		case "revokecert":
+			uname := flag.Arg(1)
+			if uname == "" {
+				log.Fatalln("Username must be given")
+			}
+
+			// The fingerprint is optional, so flags can start at the second or third argument
+			args, fp := flag.Args()[2:], ""
+			if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+				fp, args = args[0], args[1:]
+			}
+
+			var (
+				revokeFlags = flag.NewFlagSet("revokecert", flag.ExitOnError)
+				all         = revokeFlags.Bool("all", false, "Revoke all certificates of the user")
+				users       = revokeFlags.String("users", "", "User file of a virtual host, default is the normal user file")
+			)
+			revokeFlags.Parse(args)
+			ustore = selectUserStore(ustore, *users)
+
+			usr, ok := ustore.Users[uname]
+			if !ok {
+				log.Fatalf("User %q doesn't exist\n", uname)
+			}
+
+			// Without fingerprint, the certificates are only listed
+			if fp == "" && !*all {
+				if len(usr.Certificates) == 0 {
+					log.Printf("User %s has no client certificates\n", uname)
+				}
+				for _, c := range usr.Certificates {
+					fmt.Printf("%s\tvalid until %s\n", c.Fingerprint, c.Expires.Format(time.RFC1123))
+				}
+				os.Exit(0)
+			}
+
+			n := usr.revokeCertificate(fp)
+			if n == 0 {
+				log.Fatalf("User %s has no certificate with fingerprint %s\n", uname, fp)
+			}
+			ustore.Users[uname] = usr
+
+			err = ustore.Save()
+			if err != nil {
+				log.Fatalln("Error while saving user data:", err.Error())
+			}
+			log.Printf("Revoked %d certificate(s) of user %s, a running server picks this up after a restart\n", n, uname)
+			os.Exit(0)
+		case "totp":
+			uname := flag.Arg(1)
+			if uname == "" {
+				log.Fatalln("Username must be given")
+			}
+
+			var (
+				totpFlags = flag.NewFlagSet("totp", flag.ExitOnError)
+				issuer    = totpFlags.String("issuer", "upduck", "Name that authenticator apps show for the account")
+				disable   = totpFlags.Bool("disable", false, "Remove two-factor authentication from the user")
+				users     = totpFlags.String("users", "", "User file of a virtual host, default is the normal user file")
+			)
+			totpFlags.Parse(flag.Args()[2:])
+			ustore = selectUserStore(ustore, *users)
+
+			usr, ok := ustore.Users[uname]
+			if !ok {
+				log.Fatalf("User %q doesn't exist, create it with \"upduck adduser\" first\n", uname)
+			}
+
+			usr.TOTPStep = 0
+			if *disable {
+				usr.TOTPSecret = ""
+			} else {
+				usr.TOTPSecret, err = newTOTPSecret()
+				if err != nil {
+					log.Fatalln("Error while creating TOTP secret:", err.Error())
+				}
+			}
+			ustore.Users[uname] = usr
+
+			err = ustore.Save()
+			if err != nil {
+				log.Fatalln("Error while saving user data:", err.Error())
+			}
+
+			if *disable {
+				log.Println("Successfully disabled two-factor authentication for user", uname)
+				os.Exit(0)
+			}
+
+			uri := totpURI(*issuer, uname, usr.TOTPSecret)
+			fmt.Println(uri)
+			log.Printf("Add this URI to an authenticator app, e.g. by showing it as QR code with \"qrencode -t ansiutf8 '%s'\"\n", uri)
+			log.Println("For entering it manually, the secret is", usr.TOTPSecret)
+			log.Printf("From now on, %s must enter a code from the app on the login form. Basic auth is disabled for this user\n", uname)
+			os.Exit(0)
+		case "lockouts":
+			limiter, err := loadLoginLimiter(getConfigPath(lockoutsFileName))
+			if err != nil && !os.IsNotExist(err) {
+				log.Fatalln("Error while loading failed logins:", err.Error())
+			}
+
+			list := limiter.Lockouts()
+			if len(list) == 0 {
+				log.Println("Nobody is locked out")
+				os.Exit(0)
+			}
+
+			for _, l := range list {
+				if l.LockedUntil.After(l.LastFailure) {
+					fmt.Printf("%s\tlocked out until %s\n", l.Key, l.LockedUntil.Format(time.RFC1123))
+				} else {
+					fmt.Printf("%s\t%d failed login(s), next try at %s\n", l.Key, l.Failures, l.blockedUntil().Format(time.RFC1123))
+				}
+			}
+			os.Exit(0)
+		case "unlock":
+			limiter, err := loadLoginLimiter(getConfigPath(lockoutsFileName))
+			if err != nil && !os.IsNotExist(err) {
+				log.Fatalln("Error while loading failed logins:", err.Error())
+			}
+
+			// Without argument, everyone is unlocked
+			n, err := limiter.Clear(flag.Arg(1))
+			if err != nil {
+				log.Fatalln("Error while saving failed logins:", err.Error())
+			}
+			log.Printf("Removed %d lockout(s), a running server picks this up with the next login\n", n)
+			os.Exit(0)
 		}
 	}
 
@@ -194,6 +847,12 @@ func ParseConfig() (c Config, ustore *UserStore, err error) {
 
 		os.MkdirAll(filepath.Dir(cfgPath), 0644)
 
+		// Hosts can only be configured in the file, so we keep them
+		var old Config
+		if loadConfigFile(cfgPath, &old) == nil {
+			c.Hosts = old.Hosts
+		}
+
 		f, err := os.Create(cfgPath)
 		if err != nil {
 			return c, ustore, err
@@ -213,7 +872,7 @@ func ParseConfig() (c Config, ustore *UserStore, err error) {
 	} else if *duckDNSToken == "" && *duckDNSSite == "" && *letsEncryptEmail == "" {
 		cfgPath := getConfigPath(configFileName)
 		// If no flags *except* maybe -p have been set, we just load the config file
-		f, err := os.Open(cfgPath)
+		err := loadConfigFile(cfgPath, &c)
 		if err != nil {
 			if !os.IsNotExist(err) {
 				return c, ustore, err
@@ -221,16 +880,10 @@ func ParseConfig() (c Config, ustore *UserStore, err error) {
 			log.Println("[Warn] Config file does not yet exist. You can create one with the -save flag")
 			goto breakout
 		}
-		defer f.Close()
-
-		err = json.NewDecoder(f).Decode(&c)
-		if err != nil {
-			return c, ustore, err
-		}
 
 		log.Println("Loaded config file from", cfgPath)
 
-		// Now, if -p, -sp, -dir or -disallow-listings were given, we use that value instead of the saved one
+		// Now, if -p, -sp, -dir, -disallow-listings, -upload, -webdav, -template, -assets, -session-lifetime, -update-interval, -duckdns-url, -subdomain, -cert, -key, -dns-provider, -domain, -rfc2136-server, -rfc2136-zone, -tsig-key, -tsig-secret, -tsig-algorithm, -ip-url, -acme-ca, -acme-staging, -eab-kid, -eab-hmac, -acme-root, -redirect, -external-port, -hsts, -client-auth, -client-ca, -lan-https or -lan-sp were given, we use that value instead of the saved one
 		flag.Visit(func(f *flag.Flag) {
 			if f.Name == "p" {
 				c.ServerPort = *serverPort
@@ -244,19 +897,115 @@ func ParseConfig() (c Config, ustore *UserStore, err error) {
 			if f.Name == "disallow-listings" {
 				c.DisallowDirectoryListings = *disallowDirectoryListings
 			}
+			if f.Name == "upload" {
+				c.AllowUploads = *allowUploads
+			}
+			if f.Name == "webdav" {
+				c.WebDAV = *webDAV
+			}
+			if f.Name == "template" {
+				c.TemplateFile = *templateFile
+			}
+			if f.Name == "assets" {
+				c.AssetsDir = *assetsDir
+			}
+			if f.Name == "session-lifetime" {
+				c.SessionLifetime = Duration(*sessionLifetime)
+			}
+			if f.Name == "update-interval" {
+				c.UpdateInterval = Duration(*updateInterval)
+			}
+			if f.Name == "duckdns-url" {
+				c.DuckDNSUpdateURL = *duckDNSUpdateURL
+			}
+			if f.Name == "subdomain" {
+				c.Subdomains = parseSubdomains(subdomains)
+			}
+			if f.Name == "cert" {
+				c.CertFile = *certFile
+			}
+			if f.Name == "key" {
+				c.KeyFile = *keyFile
+			}
+			if f.Name == "dns-provider" {
+				c.DNSProvider = strings.ToLower(*dnsProvider)
+			}
+			if f.Name == "domain" {
+				c.Domains = parseDomainList(*domainList)
+			}
+			if f.Name == "rfc2136-server" {
+				c.RFC2136Server = *rfc2136Server
+			}
+			if f.Name == "rfc2136-zone" {
+				c.RFC2136Zone = *rfc2136Zone
+			}
+			if f.Name == "tsig-key" {
+				c.TSIGKeyName = *tsigKeyName
+			}
+			if f.Name == "tsig-secret" {
+				c.TSIGSecret = *tsigSecret
+			}
+			if f.Name == "tsig-algorithm" {
+				c.TSIGAlgorithm = *tsigAlgorithm
+			}
+			if f.Name == "ip-url" {
+				c.IPLookupURL = *ipLookupURL
+			}
+			if f.Name == "acme-ca" {
+				c.ACMEDirectory = *acmeDirectory
+			}
+			if f.Name == "acme-staging" {
+				c.ACMEStaging = *acmeStaging
+			}
+			if f.Name == "eab-kid" {
+				c.ACMEEABKeyID = *acmeEABKeyID
+			}
+			if f.Name == "eab-hmac" {
+				c.ACMEEABMACKey = *acmeEABMACKey
+			}
+			if f.Name == "acme-root" {
+				c.ACMETrustedRoot = *acmeTrustedRoot
+			}
+			if f.Name == "redirect" {
+				c.RedirectHTTPS = *redirectHTTPS
+			}
+			if f.Name == "external-port" {
+				c.ExternalPort = *externalPort
+			}
+			if f.Name == "hsts" {
+				c.HSTS = *hstsPolicy
+			}
+			if f.Name == "client-auth" {
+				c.ClientAuth = strings.ToLower(*clientAuthMode)
+			}
+			if f.Name == "client-ca" {
+				c.ClientCAFile = *clientCAFile
+			}
+			if f.Name == "lan-https" {
+				c.LANHTTPS = *lanHTTPS
+				// Config files of older versions don't have this port
+				if c.LANSecurePort == 0 {
+					c.LANSecurePort = *lanSecurePort
+				}
+			}
+			if f.Name == "lan-sp" {
+				c.LANSecurePort = *lanSecurePort
+			}
 		})
 	}
 
 breakout:
 	// Warn on certain flag combinations
-	if c.DuckDNSToken == "" {
-		if c.DuckDNSSite == "" {
+	if c.DNSProvider == "rfc2136" {
+		log.Println("Updating domains", strings.Join(c.Domains, ", "), "on DNS server", c.RFC2136Server)
+	} else if c.DuckDNSToken == "" {
+		if len(c.DuckDNSSites) == 0 {
 			log.Println("Not using secure DuckDNS server")
 		} else {
 			log.Println("Token missing for your DuckDNS site")
 		}
 	} else {
-		if c.DuckDNSSite == "" {
+		if len(c.DuckDNSSites) == 0 {
 			log.Println("DuckDNS site missing, you only gave the token")
 		}
 	}
@@ -264,6 +1013,115 @@ breakout:
 	return
 }
 
+// loadConfigFile reads the configuration file at cfgPath into c
+func loadConfigFile(cfgPath string, c *Config) (err error) {
+	f, err := os.Open(cfgPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(c)
+	if err != nil {
+		return
+	}
+
+	// Older versions only had one site
+	if c.LegacyDuckDNSSite != "" {
+		c.DuckDNSSites = append([]string{c.LegacyDuckDNSSite}, c.DuckDNSSites...)
+		c.LegacyDuckDNSSite = ""
+	}
+
+	return
+}
+
+// parseSiteList parses a comma-separated list of DuckDNS sites, e.g. "first,second.duckdns.org" => ["first", "second"]
+func parseSiteList(list string) (sites []string) {
+	for _, site := range strings.Split(list, ",") {
+		site = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(site)), ".duckdns.org")
+		if site != "" {
+			sites = append(sites, site)
+		}
+	}
+	return
+}
+
+// parseDomainList parses a comma-separated list of domain names
+func parseDomainList(list string) (domains []string) {
+	for _, domain := range strings.Split(list, ",") {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return
+}
+
+// guessBaseURL returns the most likely URL someone can reach the server on
+func guessBaseURL(c Config) string {
+	if provider, err := newDNSProvider(c); err == nil && provider != nil && len(provider.Domains()) > 0 {
+		if c.ExternalPort != 0 && c.ExternalPort != 443 {
+			return fmt.Sprintf("https://%s:%d", provider.Domains()[0], c.ExternalPort)
+		}
+		if c.ExternalPort == 0 {
+			log.Println("[Info] The link doesn't contain the external port forwarded in your router, you can set the complete server URL with the -url option")
+		}
+		return "https://" + provider.Domains()[0]
+	}
+
+	ext, err := externalIP()
+	if err != nil {
+		ext = "localhost"
+	}
+
+	return fmt.Sprintf("http://%s:%d", ext, c.ServerPort)
+}
+
+// parseSubdomains parses "subdomain=directory" flag values
+func parseSubdomains(values []string) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	var subs = make(map[string]string)
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		sub := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || sub == "" || strings.Contains(sub, ".") || parts[1] == "" {
+			log.Fatalf("Invalid subdomain %q, it must look like \"photos=path/to/dir\"\n", v)
+		}
+		subs[sub] = parts[1]
+	}
+
+	return subs
+}
+
+// selectUserStore returns the user store from the given user file, or ustore if fn is empty
+func selectUserStore(ustore *UserStore, fn string) *UserStore {
+	if fn == "" {
+		return ustore
+	}
+
+	other, err := loadUsers(userFilePath(fn))
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalln("Error while loading user file:", err.Error())
+	}
+
+	return other
+}
+
+// stringList is a flag.Value that collects all values of a flag that is given multiple times
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
 // getConfigPath returns the config path while respecting certain environment variables
 func getConfigPath(fn string) string {
 	cfgDirPath := os.Getenv("XDG_CONFIG_HOME")
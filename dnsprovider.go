@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/duckdns"
+)
+
+// DNSProvider manages the DNS records of the domains this device is reachable on
+type DNSProvider interface {
+	// Name is used in log messages, e.g. "DuckDNS"
+	Name() string
+
+	// Domains returns the full domain names that point to this device
+	Domains() []string
+
+	// UpdateIP points all domains to the current IP address of this device
+	UpdateIP(ctx context.Context) (UpdateResult, error)
+
+	// DNS01Solver returns a solver for the ACME DNS challenge, which is used for getting certificates
+	DNS01Solver() *certmagic.DNS01Solver
+}
+
+// UpdateResult is the information a DNS provider returns about an update
+type UpdateResult struct {
+	// IP and IPv6 are the addresses that are now recorded for the domains
+	IP   string
+	IPv6 string
+
+	// Changed is true if the addresses are different from the ones that were recorded before
+	Changed bool
+}
+
+// String returns all recorded addresses, e.g. "1.2.3.4" or "1.2.3.4 and 2001:db8::1"
+func (r UpdateResult) String() string {
+	if r.IPv6 == "" {
+		return r.IP
+	}
+	if r.IP == "" {
+		return r.IPv6
+	}
+	return r.IP + " and " + r.IPv6
+}
+
+// isRejectedUpdate returns whether err means that the provider will never accept our updates, e.g. because of a wrong token
+func isRejectedUpdate(err error) bool {
+	return errors.Is(err, ErrDuckDNSRejected) || errors.Is(err, ErrRFC2136Rejected)
+}
+
+// newDNSProvider returns the DNS provider selected in c. If no provider is configured, it returns nil
+func newDNSProvider(c Config) (DNSProvider, error) {
+	switch c.DNSProvider {
+	case "", "duckdns":
+		if len(c.DuckDNSSites) == 0 || c.DuckDNSToken == "" {
+			return nil, nil
+		}
+
+		return &duckDNSProvider{
+			updateURL: c.DuckDNSUpdateURL,
+			sites:     c.DuckDNSSites,
+			token:     c.DuckDNSToken,
+		}, nil
+	case "rfc2136":
+		return newRFC2136Provider(c)
+	default:
+		return nil, fmt.Errorf("unknown DNS provider %q, must be \"duckdns\" or \"rfc2136\"", c.DNSProvider)
+	}
+}
+
+// duckDNSProvider updates DuckDNS sites
+type duckDNSProvider struct {
+	updateURL string
+	sites     []string
+	token     string
+}
+
+func (p *duckDNSProvider) Name() string {
+	return "DuckDNS"
+}
+
+func (p *duckDNSProvider) Domains() []string {
+	return duckDNSDomains(p.sites)
+}
+
+func (p *duckDNSProvider) UpdateIP(ctx context.Context) (UpdateResult, error) {
+	// DuckDNS detects our IPv4 address by itself, but IPv6 addresses must be sent explicitly
+	ipv6, _ := externalIPv6()
+
+	return PingDuckDNS(ctx, p.updateURL, p.sites, p.token, ipv6)
+}
+
+func (p *duckDNSProvider) DNS01Solver() *certmagic.DNS01Solver {
+	return &certmagic.DNS01Solver{
+		DNSProvider: &duckdns.Provider{
+			APIToken: p.token,
+		},
+	}
+}
+
+// publicIPv4 returns the IPv4 address this device uses on the internet by asking the service at lookupURL.
+// If lookupURL is empty, the local address is returned, which is useful for DNS servers in the local network
+func publicIPv4(ctx context.Context, lookupURL string) (ip string, err error) {
+	if lookupURL == "" {
+		return externalIP()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lookupURL, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, lookupURL)
+	}
+
+	body, err := readLimited(resp.Body, 64)
+	if err != nil {
+		return
+	}
+
+	parsed := net.ParseIP(strings.TrimSpace(body))
+	if parsed == nil || parsed.To4() == nil {
+		return "", fmt.Errorf("%s returned %q, which is not an IPv4 address", lookupURL, body)
+	}
+
+	return parsed.String(), nil
+}
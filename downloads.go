@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var errDownloadsUsedUp = errors.New("this link has reached its download limit")
+
+// DownloadCounter keeps track of how often share links with a download limit have been used
+type DownloadCounter struct {
+	// map[link ID]usage
+	Links map[string]linkUsage `json:"links"`
+
+	filepath string
+	mut      *sync.Mutex
+}
+
+type linkUsage struct {
+	Downloads int       `json:"downloads"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Remaining returns how many downloads are left for the given link
+func (d *DownloadCounter) Remaining(l shareLink) int {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	return l.MaxDownloads - d.Links[l.ID].Downloads
+}
+
+// Take counts one download for the given link. It returns errDownloadsUsedUp if no downloads are left
+func (d *DownloadCounter) Take(l shareLink) (err error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	usage := d.Links[l.ID]
+	if usage.Downloads >= l.MaxDownloads {
+		return errDownloadsUsedUp
+	}
+
+	usage.Downloads++
+	usage.Expires = l.Expires
+	d.Links[l.ID] = usage
+
+	// We cannot allow the download if it isn't persisted, else restarting the server would reset the counter
+	err = d.save()
+	if err != nil {
+		usage.Downloads--
+		d.Links[l.ID] = usage
+	}
+
+	return
+}
+
+// save writes the counter to disk, d.mut must be held by the caller
+func (d *DownloadCounter) save() (err error) {
+	// Links that expired cannot be used anyways, so we don't need to remember them
+	now := time.Now()
+	for id, usage := range d.Links {
+		if now.After(usage.Expires) {
+			delete(d.Links, id)
+		}
+	}
+
+	content, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+
+	return writeFileAtomic(d.filepath, bytes.NewReader(content))
+}
+
+// loadDownloadCounter loads download counts from the given file
+func loadDownloadCounter(filepath string) (d *DownloadCounter, err error) {
+	// in case of error we must return an empty DownloadCounter, not nil
+	d = &DownloadCounter{
+		Links:    make(map[string]linkUsage),
+		filepath: filepath,
+		mut:      new(sync.Mutex),
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(d)
+
+	if d.Links == nil {
+		d.Links = make(map[string]linkUsage)
+	}
+
+	return
+}
+
+// isDownload returns whether r counts as a download. Every GET request counts, including range requests:
+// any range that is not counted could be used to get the whole file without using up the limit
+func isDownload(r *http.Request) bool {
+	return r.Method == http.MethodGet
+}
+
+// takeDownload counts a download if r uses a share link with a download limit.
+// If it returns false, the download must not happen and an error has already been sent
+func (s *Server) takeDownload(w http.ResponseWriter, r *http.Request) (ok bool, err error) {
+	link, ok := shareLinkFromRequest(r)
+	if !ok || link.MaxDownloads == 0 || !isDownload(r) {
+		return true, nil
+	}
+
+	if s.Downloads == nil {
+		return false, errors.New("download counter is not available")
+	}
+
+	err = s.Downloads.Take(link)
+	if err == errDownloadsUsedUp {
+		http.Error(w, err.Error(), http.StatusGone)
+		return false, nil
+	}
+
+	return err == nil, err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadLimitRangeRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("some content"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, _ := loadUsers(filepath.Join(dir, "users.json"))
+	downloads, _ := loadDownloadCounter(filepath.Join(dir, "downloads.json"))
+	s := &Server{
+		BaseDir:   dir,
+		ShareKey:  make([]byte, signingKeySize),
+		Downloads: downloads,
+		UserStore: users,
+	}
+
+	link, err := newShareLink(s.ShareKey, "file.txt", time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name       string
+		method     string
+		rangeValue string
+		want       int
+	}{
+		{"range with space", http.MethodGet, "bytes= 0-", http.StatusPartialContent},
+		{"repeated range with space", http.MethodGet, "bytes= 0-", http.StatusGone},
+		{"range from second byte", http.MethodGet, "bytes=1-", http.StatusGone},
+		{"multiple ranges", http.MethodGet, "bytes=5-,0-4", http.StatusGone},
+		{"without range", http.MethodGet, "", http.StatusGone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/file.txt?"+shareParam+"="+link.Token, nil)
+			if tt.rangeValue != "" {
+				r.Header.Set("Range", tt.rangeValue)
+			}
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	if rem := downloads.Remaining(link); rem != 0 {
+		t.Errorf("%d downloads remaining, want 0", rem)
+	}
+}
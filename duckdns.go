@@ -1,29 +1,149 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
-const urlTemplate = "https://www.duckdns.org/update?domains=%s&token=%s"
+// defaultUpdateURL is the DuckDNS API endpoint for updating the IP address of a domain
+const defaultUpdateURL = "https://www.duckdns.org/update"
+
+// ErrDuckDNSRejected is returned when DuckDNS answers "KO", which happens if the token or site is wrong
+var ErrDuckDNSRejected = errors.New("DuckDNS rejected the update, please make sure your token and site are correct")
+
+// DuckDNSStatusError is returned when DuckDNS answers with an unexpected HTTP status code
+type DuckDNSStatusError struct {
+	StatusCode int
+}
+
+func (e *DuckDNSStatusError) Error() string {
+	return fmt.Sprintf("unexpected error status code %d", e.StatusCode)
+}
+
+// DuckDNSResponseError is returned when the response of DuckDNS cannot be understood
+type DuckDNSResponseError struct {
+	Body string
+}
+
+func (e *DuckDNSResponseError) Error() string {
+	return fmt.Sprintf("unexpected response from DuckDNS: %q", e.Body)
+}
+
+// duckDNSDomains returns the full domain names for the given sites, e.g. "test" => "test.duckdns.org"
+func duckDNSDomains(sites []string) (domains []string) {
+	for _, site := range sites {
+		domains = append(domains, site+".duckdns.org")
+	}
+	return
+}
 
 var c = &http.Client{
 	Timeout: 10 * time.Second,
 }
 
-// PingDuckDNS tells DuckDNS our IP address
-// This is documented on their site: https://www.duckdns.org/install.jsp
-func PingDuckDNS(site, token string) (err error) {
-	resp, err := c.Get(fmt.Sprintf(urlTemplate, site, token))
+// PingDuckDNS tells DuckDNS our IP address. DuckDNS detects the IPv4 address itself, if ipv6 is not empty it is set as AAAA record
+// This is documented on their site: https://www.duckdns.org/install.jsp and https://www.duckdns.org/spec.jsp
+// All sites are updated in one request, which is cancelled with ctx
+func PingDuckDNS(ctx context.Context, updateURL string, sites []string, token, ipv6 string) (res UpdateResult, err error) {
+	u, err := url.Parse(updateURL)
+	if err != nil {
+		return
+	}
+
+	q := u.Query()
+	q.Set("domains", strings.Join(sites, ","))
+	q.Set("token", token)
+	q.Set("verbose", "true")
+	if ipv6 != "" {
+		q.Set("ipv6", ipv6)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return
 	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return res, redactURLError(err)
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		return fmt.Errorf("unexpected error status code %d", resp.StatusCode)
+		return res, &DuckDNSStatusError{StatusCode: resp.StatusCode}
+	}
+
+	return parseDuckDNSResponse(resp.Body)
+}
+
+// redactURLError removes the query from the URL in err, for DuckDNS it contains the token that should never be logged
+func redactURLError(err error) error {
+	ue, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+
+	redacted := "(invalid URL)"
+	if u, perr := url.Parse(ue.URL); perr == nil {
+		u.RawQuery = ""
+		u.User = nil
+		redacted = u.String()
+	}
+
+	return &url.Error{Op: ue.Op, URL: redacted, Err: ue.Err}
+}
+
+// parseDuckDNSResponse parses a verbose DuckDNS response, which looks like this:
+//
+//	OK
+//	1.2.3.4
+//	2001:db8::1
+//	UPDATED
+//
+// The IPv6 line is empty if no IPv6 address is known, the last line is "NOCHANGE" if nothing changed.
+// If the request was not successful, the response is only "KO"
+func parseDuckDNSResponse(r io.Reader) (res UpdateResult, err error) {
+	body, err := readLimited(r, 1024)
+	if err != nil {
+		return
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+
+	switch {
+	case len(lines) >= 1 && lines[0] == "KO":
+		return res, ErrDuckDNSRejected
+	case len(lines) == 1 && lines[0] == "OK":
+		// Non-verbose response, e.g. from a server that doesn't support verbose output
+		return res, nil
+	case len(lines) != 4 || lines[0] != "OK":
+		return res, &DuckDNSResponseError{Body: body}
+	}
+
+	res = UpdateResult{
+		IP:      lines[1],
+		IPv6:    lines[2],
+		Changed: lines[3] == "UPDATED",
 	}
 
 	return
 }
+
+// readLimited reads at most n bytes from r
+func readLimited(r io.Reader, n int64) (string, error) {
+	var sb strings.Builder
+	_, err := io.Copy(&sb, io.LimitReader(r, n))
+	return sb.String(), err
+}
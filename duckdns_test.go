@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseDuckDNSResponse(t *testing.T) {
+	var tests = []struct {
+		name    string
+		body    string
+		want    UpdateResult
+		wantErr error
+	}{
+		{"verbose updated", "OK\n1.2.3.4\n2001:db8::1\nUPDATED", UpdateResult{IP: "1.2.3.4", IPv6: "2001:db8::1", Changed: true}, nil},
+		{"verbose no change", "OK\n1.2.3.4\n\nNOCHANGE", UpdateResult{IP: "1.2.3.4"}, nil},
+		{"verbose with CRLF", "OK\r\n1.2.3.4\r\n\r\nUPDATED\r\n", UpdateResult{IP: "1.2.3.4", Changed: true}, nil},
+		{"non-verbose OK", "OK", UpdateResult{}, nil},
+		{"non-verbose KO", "KO", UpdateResult{}, ErrDuckDNSRejected},
+		{"verbose KO", "KO\n\n\n", UpdateResult{}, ErrDuckDNSRejected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDuckDNSResponse(strings.NewReader(tt.body))
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDuckDNSResponseInvalid(t *testing.T) {
+	var tests = []string{
+		"",
+		"<html>Bad Gateway</html>",
+		"OK\n1.2.3.4",
+		"OK\n1.2.3.4\n\nUPDATED\nmore",
+	}
+
+	for _, body := range tests {
+		_, err := parseDuckDNSResponse(strings.NewReader(body))
+		if _, ok := err.(*DuckDNSResponseError); !ok {
+			t.Errorf("parseDuckDNSResponse(%q) returned %v, want a *DuckDNSResponseError", body, err)
+		}
+	}
+}
+
+func TestPingDuckDNS(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		if r.URL.Query().Get("token") != "secret-token" {
+			w.Write([]byte("KO"))
+			return
+		}
+		w.Write([]byte("OK\n1.2.3.4\n2001:db8::1\nUPDATED"))
+	}))
+	defer srv.Close()
+
+	res, err := PingDuckDNS(context.Background(), srv.URL+"/update", []string{"a", "b"}, "secret-token", "2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Changed || res.IP != "1.2.3.4" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if want := "domains=a%2Cb&ipv6=2001%3Adb8%3A%3A1&token=secret-token&verbose=true"; query != want {
+		t.Errorf("got query %q, want %q", query, want)
+	}
+
+	_, err = PingDuckDNS(context.Background(), srv.URL+"/update", []string{"a"}, "wrong-token", "")
+	if err != ErrDuckDNSRejected {
+		t.Errorf("got error %v, want %v", err, ErrDuckDNSRejected)
+	}
+
+	// The token must not show up in errors, they are logged
+	srv.Close()
+	_, err = PingDuckDNS(context.Background(), srv.URL+"/update", []string{"a"}, "secret-token", "")
+	if err == nil || strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("got error %v, want one without the token", err)
+	}
+}
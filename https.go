@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often certReloader looks for changed certificate files
+const certCheckInterval = 10 * time.Second
+
+// serveHTTPS serves handler over HTTPS on the given port until ctx is cancelled
+func serveHTTPS(ctx context.Context, port int, tlsConfig *tls.Config, handler http.Handler) (err error) {
+	tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
+
+	srv := &http.Server{
+		Addr:              ":" + strconv.Itoa(port),
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       5 * time.Minute,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		err := srv.Shutdown(context.Background())
+		if err != nil {
+			log.Println("[Warning] Error while shutting down HTTPS server:", err.Error())
+		}
+	}()
+
+	// The certificates come from tlsConfig, so no files are given here
+	err = srv.ListenAndServeTLS("", "")
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// certReloader provides a certificate from PEM files and reloads it when they change on disk
+type certReloader struct {
+	certFile, keyFile string
+
+	mut       sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// newCertReloader loads the certificate from the given files
+func newCertReloader(certFile, keyFile string) (c *certReloader, err error) {
+	c = &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	c.modTime = c.filesModTime()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	c.cert = &cert
+	c.lastCheck = time.Now()
+
+	return c, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if time.Since(c.lastCheck) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.lastCheck = time.Now()
+
+	modTime := c.filesModTime()
+	if modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+
+	// If the files are being replaced right now we might get only one of them, so we keep the old certificate until both fit together
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		log.Println("[Warning] Error while reloading certificate, still using the old one:", err.Error())
+		return c.cert, nil
+	}
+
+	log.Println("Reloaded certificate from", c.certFile)
+	c.cert = &cert
+	c.modTime = modTime
+
+	return c.cert, nil
+}
+
+// filesModTime returns the latest modification time of the certificate and key file
+func (c *certReloader) filesModTime() (latest time.Time) {
+	for _, fn := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(fn)
+		if err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return
+}
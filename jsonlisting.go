@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type jsonListing struct {
+	Name     string      `json:"name"`
+	Path     string      `json:"path"`
+	ShowBack bool        `json:"show_back"`
+	Entries  []jsonEntry `json:"entries"`
+
+	// Only set for search results
+	Search    string `json:"search,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+type jsonEntry struct {
+	Name  string    `json:"name"`
+	Type  string    `json:"type"` // "directory", "file" or "symlink"
+	Size  int64     `json:"size"`
+	Mode  string    `json:"mode"`
+	MTime time.Time `json:"mtime"`
+	URL   string    `json:"url"`
+}
+
+// acceptsJSON returns whether the client prefers JSON over HTML, e.g. a script sending "Accept: application/json"
+func acceptsJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+
+		switch mt {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+
+	return false
+}
+
+// writeJSONListing writes the listing as JSON. Directories come first, in the same order as in the HTML listing
+func writeJSONListing(w http.ResponseWriter, r *http.Request, listing dirListing) error {
+	dirURL := r.URL.Path
+	if !strings.HasSuffix(dirURL, "/") {
+		dirURL += "/"
+	}
+
+	out := jsonListing{
+		Name:     listing.Name,
+		Path:     dirURL,
+		ShowBack: listing.ShowBack,
+		Entries:  make([]jsonEntry, 0, listing.Count()),
+
+		Search:    listing.Search,
+		Truncated: listing.Truncated,
+	}
+
+	for _, fi := range append(listing.Dirs, listing.Files...) {
+		out.Entries = append(out.Entries, newJSONEntry(dirURL, fi, listing.Share))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(out)
+}
+
+func newJSONEntry(dirURL string, fi os.FileInfo, share string) jsonEntry {
+	var typ = "file"
+	u := url.URL{Path: dirURL + fi.Name()}
+
+	switch {
+	case fi.IsDir():
+		typ = "directory"
+		u.Path += "/"
+	case fi.Mode()&os.ModeSymlink != 0:
+		typ = "symlink"
+	}
+
+	if share != "" {
+		u.RawQuery = shareParam + "=" + url.QueryEscape(share)
+	}
+
+	return jsonEntry{
+		Name:  fi.Name(),
+		Type:  typ,
+		Size:  fi.Size(),
+		Mode:  fi.Mode().String(),
+		MTime: fi.ModTime(),
+		URL:   u.String(),
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sortFields contains all fields that directory listings can be sorted by
+var sortFields = map[string]func(a, b os.FileInfo) bool{
+	"name": func(a, b os.FileInfo) bool {
+		return a.Name() < b.Name()
+	},
+	"size": func(a, b os.FileInfo) bool {
+		return a.Size() < b.Size()
+	},
+	"mtime": func(a, b os.FileInfo) bool {
+		return a.ModTime().Before(b.ModTime())
+	},
+}
+
+// parseSortQuery returns the sort field and order requested by the "sort" and "order" query parameters
+func parseSortQuery(r *http.Request) (sortBy, order string) {
+	sortBy = strings.ToLower(r.URL.Query().Get("sort"))
+	if _, ok := sortFields[sortBy]; !ok {
+		sortBy = "name"
+	}
+
+	order = strings.ToLower(r.URL.Query().Get("order"))
+	if order != "desc" {
+		order = "asc"
+	}
+
+	return
+}
+
+// sortFileInfos sorts infos by the given field. Entries that are equal are sorted by name
+func sortFileInfos(infos []os.FileInfo, sortBy, order string) {
+	less := sortFields[sortBy]
+	sort.SliceStable(infos, func(i, j int) bool {
+		a, b := infos[i], infos[j]
+		if order == "desc" {
+			a, b = b, a
+		}
+
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.Name() < b.Name()
+	})
+}
+
+// SortQuery returns the query string for a link that sorts the listing by field.
+// Clicking the link of the current sort field again reverses the order
+func (d dirListing) SortQuery(field string) string {
+	q := url.Values{}
+	q.Set("sort", field)
+
+	if d.Sort == field && d.Order == "asc" {
+		q.Set("order", "desc")
+	} else {
+		q.Set("order", "asc")
+	}
+
+	if d.Search != "" {
+		q.Set("search", d.Search)
+	}
+	if d.Share != "" {
+		q.Set(shareParam, d.Share)
+	}
+
+	return "?" + q.Encode()
+}
+
+// Count returns the number of entries in the listing
+func (d dirListing) Count() int {
+	return len(d.Dirs) + len(d.Files)
+}
+
+var templateFuncs = template.FuncMap{
+	"size":     humanSize,
+	"modtime":  formatModTime,
+	"filetype": fileType,
+	"asset":    assetURL,
+}
+
+// humanSize formats a file size in bytes using binary units, e.g. 1536 => "1.5 KiB"
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatModTime(t time.Time) string {
+	return t.Format("2006-01-02 15:04")
+}
+
+// fileType returns the MIME type of a file based on its extension, e.g. "application/pdf"
+func fileType(name string) string {
+	mt, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name)))
+	if err != nil || mt == "" {
+		return "File"
+	}
+
+	return mt
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 365 * 24 * time.Hour
+)
+
+// caPermittedNetworks are the only IP addresses the local CA can issue certificates for, besides the name localhost.
+// Devices trust the CA, with these name constraints a stolen key still can't be used for other websites
+var caPermittedNetworks = parseNetworks(
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16",
+	"fc00::/7", "fe80::/10", "::1/128",
+)
+
+func parseNetworks(cidrs ...string) (nets []*net.IPNet) {
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// isPermittedIP returns whether the local CA can issue certificates for ip
+func isPermittedIP(ip net.IP) bool {
+	for _, n := range caPermittedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// localCA is a certificate authority that is created on the first start and then stored in the configuration directory.
+// Devices that should trust the certificates it issues need to install its certificate
+type localCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	// CertPEM is the PEM-encoded certificate of the CA
+	CertPEM []byte
+
+	mut  sync.Mutex
+	leaf *tls.Certificate
+}
+
+// loadOrCreateLocalCA loads the CA from the given files, or creates and saves a new one if they don't exist
+func loadOrCreateLocalCA(certPath, keyPath string) (ca *localCA, err error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if os.IsNotExist(err) {
+		return createLocalCA(certPath, keyPath)
+	}
+	if err != nil {
+		return
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, errors.New("invalid PEM data in CA files")
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return
+	}
+
+	// CAs from older versions can issue certificates for any website
+	if !cert.PermittedDNSDomainsCritical {
+		log.Printf("[Warning] The local CA in %s has no name constraints. Delete it and %s to create a new one, then install the new CA on your devices\n", certPath, keyPath)
+	}
+
+	return &localCA{
+		cert:    cert,
+		key:     key,
+		CertPEM: certPEM,
+	}, nil
+}
+
+func createLocalCA(certPath, keyPath string) (ca *localCA, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"upduck"},
+			CommonName:   "upduck local CA " + hostname,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         []string{"localhost"},
+		PermittedIPRanges:           caPermittedNetworks,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	ca = &localCA{
+		cert:    cert,
+		key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+
+	err = os.MkdirAll(filepath.Dir(certPath), 0755)
+	if err != nil {
+		return
+	}
+
+	// Only we should be able to read the key, else anyone could issue certificates that are trusted by devices
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(certPath, ca.CertPEM, 0644)
+	if err != nil {
+		return
+	}
+
+	log.Println("Created local certificate authority in", certPath)
+
+	return ca, nil
+}
+
+// issue creates a certificate signed by the CA from template that is valid for the given duration
+func (ca *localCA) issue(template *x509.Certificate, validity time.Duration) (cert tls.Certificate, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	template.SerialNumber, err = randomSerial()
+	if err != nil {
+		return
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(validity)
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// issueServerCert creates a server certificate for localhost and all given IP addresses that the CA is allowed to
+// issue certificates for, other addresses are left out
+func (ca *localCA) issueServerCert(ips []net.IP) (tls.Certificate, error) {
+	var permitted []net.IP
+	for _, ip := range ips {
+		if isPermittedIP(ip) {
+			permitted = append(permitted, ip)
+		}
+	}
+
+	return ca.issue(&x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"upduck"},
+			CommonName:   "upduck LAN server",
+		},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: append([]net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, permitted...),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, leafValidity)
+}
+
+// issueClientCert creates a certificate that logs in the given user
+func (ca *localCA) issueClientCert(username string, validity time.Duration) (tls.Certificate, error) {
+	return ca.issue(&x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"upduck"},
+			CommonName:   username,
+		},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, validity)
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate. It returns a certificate for all current
+// LAN addresses and creates a new one if the address of the connection is not covered, e.g. after a network change
+func (ca *localCA) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ca.mut.Lock()
+	defer ca.mut.Unlock()
+
+	// Public addresses can't be in the certificate, so there's no need for a new one
+	var localIP net.IP
+	if addr, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok && isPermittedIP(addr.IP) {
+		localIP = addr.IP
+	}
+
+	if ca.leaf != nil && time.Now().Before(ca.leaf.Leaf.NotAfter) && coversIP(ca.leaf.Leaf, localIP) {
+		return ca.leaf, nil
+	}
+
+	ips, err := interfaceIPs()
+	if err != nil {
+		return nil, err
+	}
+	if localIP != nil && !localIP.IsLoopback() && !localIP.IsUnspecified() && !containsIP(ips, localIP) {
+		ips = append(ips, localIP)
+	}
+
+	leaf, err := ca.issueServerCert(ips)
+	if err != nil {
+		return nil, err
+	}
+	ca.leaf = &leaf
+
+	return ca.leaf, nil
+}
+
+// coversIP returns whether cert is valid for ip. A nil ip is always covered
+func coversIP(cert *x509.Certificate, ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified() || containsIP(cert.IPAddresses, ip)
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// writeCertFiles saves the certificate and its private key as PEM files
+func writeCertFiles(cert tls.Certificate, certFile, keyFile string) (err error) {
+	key, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("unsupported private key type")
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return
+	}
+
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalCANameConstraints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := loadOrCreateLocalCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	verify := func(cert *x509.Certificate, name string, usage x509.ExtKeyUsage) error {
+		_, err := cert.Verify(x509.VerifyOptions{
+			DNSName:   name,
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{usage},
+		})
+		return err
+	}
+
+	server, err := ca.issueServerCert([]net.IP{net.ParseIP("192.168.1.2"), net.ParseIP("fd00::2"), net.ParseIP("203.0.113.7")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"localhost", "127.0.0.1", "::1", "192.168.1.2", "fd00::2"} {
+		if err := verify(server.Leaf, name, x509.ExtKeyUsageServerAuth); err != nil {
+			t.Errorf("server certificate is not valid for %s: %s", name, err.Error())
+		}
+	}
+	if containsIP(server.Leaf.IPAddresses, net.ParseIP("203.0.113.7")) {
+		t.Error("server certificate contains a public IP address")
+	}
+
+	client, err := ca.issueClientCert("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(client.Leaf, "", x509.ExtKeyUsageClientAuth); err != nil {
+		t.Errorf("client certificate is not valid: %s", err.Error())
+	}
+
+	// The CA key could still sign other certificates, but nobody should accept them
+	var outside = []*x509.Certificate{
+		{Subject: pkix.Name{CommonName: "example.com"}, DNSNames: []string{"example.com"}},
+		{Subject: pkix.Name{CommonName: "public"}, IPAddresses: []net.IP{net.ParseIP("203.0.113.7")}},
+	}
+	for _, template := range outside {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+		cert, err := ca.issue(template, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verify(cert.Leaf, "", x509.ExtKeyUsageServerAuth); err == nil {
+			t.Errorf("certificate for %s is valid despite the name constraints", template.Subject.CommonName)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxLoginFailures is the number of failed logins after which an IP address or user is locked out
+	maxLoginFailures = 10
+	lockoutDuration  = 15 * time.Minute
+
+	// After a failed login, the next attempt is only possible after a delay that doubles with every failure
+	minLoginDelay = time.Second
+	maxLoginDelay = 30 * time.Second
+
+	// failureMemory is how long failed logins are remembered
+	failureMemory = time.Hour
+)
+
+// LoginLimiter slows down and locks out clients that try to guess passwords.
+// Failures are counted per IP address and per user name, so distributed attacks on one account are also stopped
+type LoginLimiter struct {
+	// map["ip:1.2.3.4" or "user:name"]failures
+	Entries map[string]loginFailures `json:"entries"`
+
+	filepath string
+	// modTime is the modification time of the file when it was last read or written, the lockouts
+	// command changes it while the server is running
+	modTime time.Time
+	// pending counts the logins per key that are currently being checked
+	pending map[string]int
+	mut     *sync.Mutex
+}
+
+type loginFailures struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+// blockedUntil returns when the next login attempt is allowed
+func (f loginFailures) blockedUntil() time.Time {
+	if f.LockedUntil.After(f.LastFailure) {
+		return f.LockedUntil
+	}
+
+	delay := maxLoginDelay
+	if f.Failures <= 6 {
+		delay = minLoginDelay << uint(f.Failures-1)
+	}
+	if delay > maxLoginDelay {
+		delay = maxLoginDelay
+	}
+
+	return f.LastFailure.Add(delay)
+}
+
+// limiterKeys returns the entry keys for a login attempt
+func limiterKeys(ip, uname string) []string {
+	return []string{"ip:" + ip, "user:" + uname}
+}
+
+// Reserve checks whether the client at ip can try to log in as uname now. If it can, the attempt is counted as pending
+// and must be finished with Fail or Succeed. Otherwise wait is how long the client must wait.
+// Checking and counting happens at once, so parallel requests can't try more passwords than allowed
+func (l *LoginLimiter) Reserve(ip, uname string) (wait time.Duration) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	l.reloadIfChanged()
+
+	now := time.Now()
+	for _, key := range limiterKeys(ip, uname) {
+		f := l.Entries[key]
+		if now.Sub(f.LastFailure) > failureMemory {
+			f.Failures = 0
+		}
+
+		if w := f.blockedUntil().Sub(now); w > wait {
+			wait = w
+		}
+
+		// After a failure, passwords can only be tried one after another. Pending attempts also count
+		// as failures until they are finished, else many parallel requests could avoid the lockout
+		pending := l.pending[key]
+		if (f.Failures > 0 && pending > 0) || f.Failures+pending >= maxLoginFailures {
+			if minLoginDelay > wait {
+				wait = minLoginDelay
+			}
+		}
+	}
+	if wait > 0 {
+		return
+	}
+
+	for _, key := range limiterKeys(ip, uname) {
+		l.pending[key]++
+	}
+
+	return 0
+}
+
+// finish removes a pending attempt reserved by Reserve, l.mut must be held by the caller
+func (l *LoginLimiter) finish(key string) {
+	if l.pending[key] <= 1 {
+		delete(l.pending, key)
+	} else {
+		l.pending[key]--
+	}
+}
+
+// Fail records a failed login reserved by Reserve. It returns true if this failure locked out the IP address or user
+func (l *LoginLimiter) Fail(ip, uname string) (locked bool) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	now := time.Now()
+	for _, key := range limiterKeys(ip, uname) {
+		l.finish(key)
+
+		f := l.Entries[key]
+		if now.Sub(f.LastFailure) > failureMemory {
+			f = loginFailures{}
+		}
+
+		f.Failures++
+		f.LastFailure = now
+		if f.Failures >= maxLoginFailures {
+			f.LockedUntil = now.Add(lockoutDuration)
+			f.Failures = 0
+			locked = true
+		}
+
+		l.Entries[key] = f
+	}
+
+	err := l.save()
+	if err != nil {
+		log.Println("[Warning] Error while saving failed logins:", err.Error())
+	}
+
+	return
+}
+
+// Succeed finishes an attempt reserved by Reserve and forgets previous failures of the IP address and user
+func (l *LoginLimiter) Succeed(ip, uname string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	var changed bool
+	for _, key := range limiterKeys(ip, uname) {
+		l.finish(key)
+
+		if _, ok := l.Entries[key]; ok {
+			delete(l.Entries, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	err := l.save()
+	if err != nil {
+		log.Println("[Warning] Error while saving failed logins:", err.Error())
+	}
+}
+
+// lockout is an IP address or user that currently can't log in
+type lockout struct {
+	Key string
+	loginFailures
+}
+
+// Lockouts returns all IP addresses and users that are currently locked out or delayed, sorted by key
+func (l *LoginLimiter) Lockouts() (list []lockout) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	now := time.Now()
+	for key, f := range l.Entries {
+		if f.blockedUntil().After(now) {
+			list = append(list, lockout{key, f})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+
+	return
+}
+
+// Clear removes the entry of the given IP address or user name, or all entries if name is empty.
+// It returns how many entries were removed
+func (l *LoginLimiter) Clear(name string) (n int, err error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	for key := range l.Entries {
+		if name == "" || key == "ip:"+name || key == "user:"+name || key == name {
+			delete(l.Entries, key)
+			n++
+		}
+	}
+
+	return n, l.save()
+}
+
+// reloadIfChanged loads the file again if it was changed by another process, l.mut must be held by the caller
+func (l *LoginLimiter) reloadIfChanged() {
+	fi, err := os.Stat(l.filepath)
+	if err != nil || fi.ModTime().Equal(l.modTime) {
+		return
+	}
+
+	other, err := loadLoginLimiter(l.filepath)
+	if err != nil {
+		log.Println("[Warning] Error while reloading failed logins:", err.Error())
+		return
+	}
+
+	l.Entries = other.Entries
+	l.modTime = other.modTime
+}
+
+// save writes the limiter to disk, l.mut must be held by the caller
+func (l *LoginLimiter) save() (err error) {
+	// Old failures don't matter anymore
+	now := time.Now()
+	for key, f := range l.Entries {
+		if now.Sub(f.LastFailure) > failureMemory && now.After(f.LockedUntil) {
+			delete(l.Entries, key)
+		}
+	}
+
+	content, err := json.Marshal(l)
+	if err != nil {
+		return
+	}
+
+	err = writeFileAtomic(l.filepath, bytes.NewReader(content))
+	if err != nil {
+		return
+	}
+
+	if fi, err := os.Stat(l.filepath); err == nil {
+		l.modTime = fi.ModTime()
+	}
+
+	return nil
+}
+
+// loadLoginLimiter loads failed logins from the given file
+func loadLoginLimiter(filepath string) (l *LoginLimiter, err error) {
+	// in case of error we must return an empty LoginLimiter, not nil
+	l = &LoginLimiter{
+		Entries:  make(map[string]loginFailures),
+		filepath: filepath,
+		pending:  make(map[string]int),
+		mut:      new(sync.Mutex),
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil {
+		l.modTime = fi.ModTime()
+	}
+
+	err = json.NewDecoder(f).Decode(l)
+
+	if l.Entries == nil {
+		l.Entries = make(map[string]loginFailures)
+	}
+
+	return
+}
+
+// clientIP returns the IP address of the client that sent r. IPv6 clients usually have a whole /64 network,
+// so that is used instead of the single address
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip.String()
+}
+
+// checkLogin verifies the password and TOTP code of uname with brute-force protection. If the client has to wait before
+// trying again, wait is positive and the password is not checked
+func (s *Server) checkLogin(r *http.Request, uname, passwd, code string) (ok bool, wait time.Duration) {
+	ip := clientIP(r)
+
+	if s.Logins != nil {
+		wait = s.Logins.Reserve(ip, uname)
+		if wait > 0 {
+			log.Printf("[Auth] Blocked login for user %q from %s, retry in %s\n", uname, hostOf(r.RemoteAddr), wait.Round(time.Second))
+			return false, wait
+		}
+	}
+
+	// The code is only checked after the password, else guessing passwords could use up valid codes
+	if s.UserStore.IsValidUser(uname, passwd) && s.UserStore.CheckTOTP(uname, code) {
+		if s.Logins != nil {
+			s.Logins.Succeed(ip, uname)
+		}
+		return true, 0
+	}
+
+	// This line can be used by fail2ban, the address must stay at the end
+	log.Printf("[Auth] Failed login for user %q from %s\n", uname, hostOf(r.RemoteAddr))
+
+	if s.Logins != nil && s.Logins.Fail(ip, uname) {
+		log.Printf("[Auth] Locked out user %q and %s for %s after too many failed logins\n", uname, ip, lockoutDuration)
+	}
+
+	return false, 0
+}
+
+// hostOf returns the host part of addr
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return strings.Trim(host, "[]")
+}
+
+// tooManyLogins tells a basic auth client to wait before trying again
+func tooManyLogins(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfterSeconds(wait))
+	http.Error(w, "Too many failed logins, please try again in "+wait.Round(time.Second).String(), http.StatusTooManyRequests)
+}
+
+// retryAfterSeconds returns the value of a Retry-After header, rounded up to full seconds
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int((wait + time.Second - 1) / time.Second))
+}
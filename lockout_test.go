@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiterParallelAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, _ := loadLoginLimiter(filepath.Join(dir, "lockouts.json"))
+
+	// Without previous failures, parallel logins are allowed until they would reach the lockout
+	for i := 0; i < maxLoginFailures; i++ {
+		if wait := l.Reserve("1.2.3.4", "alice"); wait != 0 {
+			t.Fatalf("attempt %d: got wait %s, want none", i+1, wait)
+		}
+	}
+	if wait := l.Reserve("1.2.3.4", "alice"); wait == 0 {
+		t.Fatalf("attempt %d was allowed while %d others are pending", maxLoginFailures+1, maxLoginFailures)
+	}
+
+	var locked bool
+	for i := 0; i < maxLoginFailures; i++ {
+		locked = l.Fail("1.2.3.4", "alice")
+	}
+	if !locked {
+		t.Errorf("%d parallel failures didn't lock out the user", maxLoginFailures)
+	}
+	if wait := l.Reserve("5.6.7.8", "alice"); wait <= minLoginDelay {
+		t.Errorf("got wait %s after lockout, want the lockout duration", wait)
+	}
+}
+
+func TestLoginLimiterOneAttemptAfterFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, _ := loadLoginLimiter(filepath.Join(dir, "lockouts.json"))
+	l.Entries["user:alice"] = loginFailures{Failures: 1, LastFailure: time.Now().Add(-time.Minute)}
+
+	if wait := l.Reserve("1.2.3.4", "alice"); wait != 0 {
+		t.Fatalf("got wait %s, want none", wait)
+	}
+	if wait := l.Reserve("5.6.7.8", "alice"); wait == 0 {
+		t.Fatal("a second attempt was allowed while the first one is pending")
+	}
+
+	l.Succeed("1.2.3.4", "alice")
+
+	if wait := l.Reserve("5.6.7.8", "alice"); wait != 0 {
+		t.Errorf("got wait %s after a successful login, want none", wait)
+	}
+	if len(l.Entries) != 0 {
+		t.Errorf("failures weren't cleared: %v", l.Entries)
+	}
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
-
-	"github.com/libdns/duckdns"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 )
@@ -22,22 +27,26 @@ func main() {
 		log.Fatalln("loading configuration:", err.Error())
 	}
 
-	// Verify that config.BaseDir exists, is accessible and a directory
-	fi, err := os.Stat(config.BaseDir)
+	// The hash for login attempts with unknown users is created now, the first one would take longer otherwise
+	dummyHash()
+
+	abs, err := checkDir(config.BaseDir)
 	if err != nil {
-		log.Fatalf("error while accessing %q: %s\n", config.BaseDir, err.Error())
+		log.Fatalln(err.Error())
 	}
 
-	if !fi.IsDir() {
-		log.Fatalf("%q is not a directory\n", config.BaseDir)
-	}
+	log.Println("Serving files from", abs)
 
-	abs, err := filepath.Abs(config.BaseDir)
+	// The DNS provider points our domains to this device and helps getting certificates for them
+	provider, err := newDNSProvider(config)
 	if err != nil {
-		log.Fatalln("cannot determine absolute path for directory:", err.Error())
+		log.Fatalln("setting up DNS provider:", err.Error())
 	}
 
-	log.Println("Serving files from", abs)
+	var domains []string
+	if provider != nil {
+		domains = provider.Domains()
+	}
 
 	// Set up web server mux
 	mux := http.NewServeMux()
@@ -45,60 +54,303 @@ func main() {
 	var s = &Server{
 		BaseDir:             abs,
 		DisallowDirectories: config.DisallowDirectoryListings,
+		AllowUploads:        config.AllowUploads,
+		SessionLifetime:     time.Duration(config.SessionLifetime),
 		UserStore:           ustore,
 	}
 
-	mux.Handle("/", s)
+	shareKey, err := loadSigningKey(getConfigPath(shareKeyFileName))
+	if err != nil {
+		log.Println("[Warning] Share links and the login form are disabled because their key could not be loaded:", err.Error())
+	} else {
+		s.ShareKey = shareKey
+	}
+
+	s.Downloads, err = loadDownloadCounter(getConfigPath(downloadsFileName))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("[Warning] Error while loading download counts of share links:", err.Error())
+	}
+
+	s.Logins, err = loadLoginLimiter(getConfigPath(lockoutsFileName))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("[Warning] Error while loading failed logins:", err.Error())
+	}
+
+	if config.TemplateFile != "" {
+		s.Template, err = loadTemplate(config.TemplateFile)
+		if err != nil {
+			log.Println("[Warning] Using built-in template because the custom template could not be loaded:", err.Error())
+		} else {
+			log.Println("Using directory listing template from", config.TemplateFile)
+		}
+	}
+
+	if config.AssetsDir != "" {
+		mux.Handle(assetsPrefix, assetsHandler(config.AssetsDir))
+		log.Println("Serving template assets from", config.AssetsDir)
+	}
+
+	if config.WebDAV {
+		s.WebDAV = newWebDAVHandler(abs)
+		log.Println("WebDAV is enabled, clients can mount the directory and modify files in it")
+	}
+
+	// Requests for configured host names are served from other directories
+	var router = &HostRouter{
+		Default: s,
+		Hosts:   make(map[string]http.Handler),
+	}
+
+	for host, hc := range config.Hosts {
+		hs, err := s.ForHost(hc)
+		if err != nil {
+			log.Fatalf("setting up host %q: %s\n", host, err.Error())
+		}
+
+		router.Hosts[normalizeHost(host)] = hs
+		log.Printf("Serving files for host %s from %s\n", host, hs.BaseDir)
+	}
+
+	// Subdomains of our domains, e.g. photos.mysite.duckdns.org, serve subdirectories
+	for sub, dir := range config.Subdomains {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(abs, dir)
+		}
+
+		hs, err := s.ForHost(HostConfig{
+			Dir:                       dir,
+			DisallowDirectoryListings: config.DisallowDirectoryListings,
+		})
+		if err != nil {
+			log.Fatalf("setting up subdomain %q: %s\n", sub, err.Error())
+		}
+
+		for _, domain := range domains {
+			router.Hosts[normalizeHost(sub+"."+domain)] = hs
+			log.Printf("Serving files for %s.%s from %s\n", sub, domain, hs.BaseDir)
+		}
+	}
+
+	mux.Handle("/", router)
 
-	if config.DuckDNSSite != "" && config.DuckDNSToken != "" {
+	// Everything running in the background stops when ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+
+	if provider != nil {
+		log.Println("Checking in with", provider.Name())
+		res, err := provider.UpdateIP(ctx)
+		if err != nil {
+			// A wrong token or site won't fix itself, but network errors might
+			if isRejectedUpdate(err) {
+				log.Fatalf("while telling %s our IP address: %s\n", provider.Name(), err.Error())
+			}
+			log.Printf("[Warning] Error while telling %s our IP address: %s\n", provider.Name(), err.Error())
+		} else if res.IP != "" || res.IPv6 != "" {
+			log.Println(provider.Name(), "has the IP address", res.String(), "for your domain")
+		}
+
+		// Keep our IP address up to date in case it changes
+		updater := &DNSUpdater{
+			Provider: provider,
+			Interval: time.Duration(config.UpdateInterval),
+
+			LastResult: res,
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			updater.Run(ctx)
+		}()
+	}
+
+	// HTTPS servers can log in users with client certificates
+	clientCerts, err := loadClientAuth(config.ClientAuth, config.ClientCAFile)
+	if err != nil {
+		log.Fatalln("loading CA for client certificates:", err.Error())
+	}
+	if clientCerts.Type != tls.NoClientCert {
+		log.Println("HTTPS servers accept client certificates for logging in, mode:", config.ClientAuth)
+	}
+
+	// The HTTPS server either uses the given certificate files or gets certificates for our domains
+	if config.CertFile != "" || config.KeyFile != "" {
+		reloader, err := newCertReloader(config.CertFile, config.KeyFile)
+		if err != nil {
+			log.Fatalln("loading certificate:", err.Error())
+		}
+
+		background.Add(1)
+		go func() {
+			defer background.Done()
+
+			log.Println("HTTPS server with certificate from", config.CertFile, "listening on port", config.SecurePort)
+			err := serveHTTPS(ctx, config.SecurePort, clientCerts.apply(&tls.Config{
+				GetCertificate: reloader.GetCertificate,
+			}), withHSTS(config.HSTS, mux))
+			if err != nil {
+				log.Fatalln("while running HTTPS server:", err.Error())
+			}
+		}()
+	} else if provider != nil {
 		// Set up HTTPS certificate resolver details
-		certmagic.DefaultACME.Agreed = true
-		certmagic.DefaultACME.Email = config.LetsEncryptEmail
-		certmagic.DefaultACME.DNS01Solver = &certmagic.DNS01Solver{
-			DNSProvider: &duckdns.Provider{
-				APIToken: config.DuckDNSToken,
-			},
+		err = configureACME(config)
+		if err != nil {
+			log.Fatalln("configuring ACME:", err.Error())
 		}
+		certmagic.DefaultACME.DNS01Solver = provider.DNS01Solver()
 
-		certmagic.HTTPPort = 0 // Choose a random aka free port for certmagics' HTTP to HTTPS redirect
 		certmagic.HTTPSPort = config.SecurePort
 
-		log.Println("Checking in with DuckDNS")
-		err = PingDuckDNS(config.DuckDNSSite, config.DuckDNSToken)
+		background.Add(1)
+		go func() {
+			defer background.Done()
+
+			certDomains := domains
+
+			// A wildcard certificate covers all subdomains. It can only be issued using the DNS challenge, which we use anyways
+			if len(config.Subdomains) > 0 {
+				for _, domain := range domains {
+					certDomains = append(certDomains, "*."+domain)
+				}
+			}
+
+			magic := certmagic.NewDefault()
+			err := magic.ManageSync(certDomains)
+			if err != nil {
+				log.Fatalln("while getting HTTPS certificates:", err.Error())
+			}
+
+			log.Println("Public HTTPS server listening on port", config.SecurePort, "- access it over the external port configured in your router on", strings.Join(certDomains, ", "))
+			err = serveHTTPS(ctx, config.SecurePort, clientCerts.apply(magic.TLSConfig()), withHSTS(config.HSTS, mux))
+			if err != nil {
+				log.Fatalln("while running HTTPS server:", err.Error())
+			}
+		}()
+	}
+
+	// Devices in the local network can use HTTPS with a certificate from our own CA
+	if config.LANHTTPS {
+		ca, err := loadOrCreateLocalCA(getConfigPath(caCertFileName), getConfigPath(caKeyFileName))
 		if err != nil {
-			log.Println("[Warning] Error while telling DuckDNS our IP address:", err.Error())
+			log.Fatalln("loading local CA:", err.Error())
 		}
 
+		background.Add(1)
 		go func() {
-			site := fmt.Sprintf("%s.duckdns.org", config.DuckDNSSite)
+			defer background.Done()
 
-			log.Println("Public HTTPS server listening on port", certmagic.HTTPSPort, "- access it over the external port configured in your router on", site)
-			err := certmagic.HTTPS([]string{site}, mux)
+			if ext, err := externalIP(); err == nil {
+				log.Printf("LAN HTTPS server starting on https://%s:%d", ext, config.LANSecurePort)
+			} else {
+				log.Printf("LAN HTTPS server starting on port %d", config.LANSecurePort)
+			}
+			err := serveHTTPS(ctx, config.LANSecurePort, clientCerts.apply(&tls.Config{
+				GetCertificate: ca.GetCertificate,
+			}), mux)
 			if err != nil {
-				log.Fatalln("while running HTTPS server:", err.Error())
+				log.Fatalln("while running LAN HTTPS server:", err.Error())
 			}
 		}()
 	}
 
-	// And the normal HTTP server
+	// And the normal HTTP server, it listens on IPv4 and IPv6 addresses
 	ext, err := externalIP()
 	if err == nil {
 		log.Printf("Local HTTP server starting on http://%s:%d", ext, config.ServerPort)
 	} else {
 		log.Printf("Local HTTP server starting on port %d", config.ServerPort)
 	}
+	if ext6, err := externalIPv6(); err == nil {
+		log.Printf("Local HTTP server is also reachable on http://[%s]:%d", ext6, config.ServerPort)
+	}
 
-	err = http.ListenAndServe(":"+strconv.Itoa(config.ServerPort), mux)
-	if err != nil {
+	// Visitors from the internet should not use unencrypted connections
+	var httpHandler http.Handler = mux
+	if config.RedirectHTTPS {
+		if provider == nil && config.CertFile == "" {
+			log.Println("[Warning] Not redirecting to HTTPS because no HTTPS server is configured")
+		} else {
+			port := config.ExternalPort
+			if port == 0 {
+				port = config.SecurePort
+			}
+
+			httpHandler = &httpsRedirect{
+				Domains: domains,
+				Port:    port,
+				Next:    mux,
+			}
+			log.Println("Requests from outside the local network are redirected to HTTPS on port", port)
+		}
+	}
+
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(config.ServerPort),
+		Handler: httpHandler,
+	}
+
+	// Stop cleanly when we are asked to
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		log.Println("Shutting down")
+		cancel()
+
+		err := srv.Shutdown(context.Background())
+		if err != nil {
+			log.Println("[Warning] Error while shutting down HTTP server:", err.Error())
+		}
+	}()
+
+	err = srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalln("while running HTTP server:", err.Error())
 	}
+
+	background.Wait()
 }
 
+// checkDir verifies that dir exists, is accessible and a directory. It returns the absolute path of dir
+func checkDir(dir string) (abs string, err error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("error while accessing %q: %s", dir, err.Error())
+	}
+
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%q is not a directory", dir)
+	}
+
+	abs, err = filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("cannot determine absolute path for directory: %s", err.Error())
+	}
+
+	return abs, nil
+}
+
+// interfaceIPs returns all addresses of network interfaces that are up, except loopback ones
+func interfaceIPs() (ips []net.IP, err error) {
+	nets, err := interfaceNetworks()
+	if err != nil {
+		return
+	}
+
+	for _, n := range nets {
+		ips = append(ips, n.IP)
+	}
+	return
+}
+
+// interfaceNetworks returns the addresses of network interfaces that are up with their network masks, except loopback ones
 // Source: https://stackoverflow.com/a/23558495 and https://play.golang.org/p/BDt3qEQ_2H
-func externalIP() (string, error) {
+func interfaceNetworks() (nets []*net.IPNet, err error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return "", err
+		return
 	}
 	for _, iface := range ifaces {
 		if iface.Flags&net.FlagUp == 0 {
@@ -109,25 +361,57 @@ func externalIP() (string, error) {
 		}
 		addrs, err := iface.Addrs()
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		for _, addr := range addrs {
-			var ip net.IP
+			var n *net.IPNet
 			switch v := addr.(type) {
 			case *net.IPNet:
-				ip = v.IP
+				n = v
 			case *net.IPAddr:
-				ip = v.IP
+				// Without a mask, the network only contains this address
+				n = &net.IPNet{IP: v.IP, Mask: net.CIDRMask(len(v.IP)*8, len(v.IP)*8)}
 			}
-			if ip == nil || ip.IsLoopback() {
+			if n == nil || n.IP == nil || n.IP.IsLoopback() {
 				continue
 			}
-			ip = ip.To4()
-			if ip == nil {
-				continue // not an ipv4 address
-			}
-			return ip.String(), nil
+			nets = append(nets, n)
 		}
 	}
+	return
+}
+
+// externalIP returns the first IPv4 address of this device
+func externalIP() (string, error) {
+	ips, err := interfaceIPs()
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		ip = ip.To4()
+		if ip == nil {
+			continue // not an ipv4 address
+		}
+		return ip.String(), nil
+	}
 	return "", errors.New("are you connected to the network?")
 }
+
+// externalIPv6 returns the first global IPv6 address of this device, which can be reached from the internet (if no firewall is in the way)
+func externalIPv6() (string, error) {
+	ips, err := interfaceIPs()
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			continue // not an ipv6 address
+		}
+		// Link-local and unique local addresses (fc00::/7) cannot be reached from the internet
+		if !ip.IsGlobalUnicast() || ip[0]&0xfe == 0xfc {
+			continue
+		}
+		return ip.String(), nil
+	}
+	return "", errors.New("no global IPv6 address found")
+}
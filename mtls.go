@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clientAuthModes maps the values of the -client-auth option to how client certificates are handled
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"":         tls.NoClientCert,
+	"off":      tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+// clientAuth configures HTTPS servers to verify client certificates, which log in users without a password
+type clientAuth struct {
+	Type tls.ClientAuthType
+	CAs  *x509.CertPool
+}
+
+// loadClientAuth returns the client certificate settings for the given mode. Certificates must be signed by a CA in caFile,
+// if it is empty the local CA is used
+func loadClientAuth(mode, caFile string) (ca clientAuth, err error) {
+	var ok bool
+	ca.Type, ok = clientAuthModes[mode]
+	if !ok {
+		return ca, fmt.Errorf("unknown client certificate mode %q, must be \"off\", \"optional\" or \"require\"", mode)
+	}
+	if ca.Type == tls.NoClientCert {
+		return
+	}
+
+	var content []byte
+	if caFile == "" {
+		var local *localCA
+		local, err = loadOrCreateLocalCA(getConfigPath(caCertFileName), getConfigPath(caKeyFileName))
+		if err != nil {
+			return
+		}
+		content = local.CertPEM
+	} else {
+		content, err = ioutil.ReadFile(caFile)
+		if err != nil {
+			return
+		}
+	}
+
+	// Only the given CA is trusted, system roots would allow certificates for any website
+	ca.CAs = x509.NewCertPool()
+	if !ca.CAs.AppendCertsFromPEM(content) {
+		return ca, fmt.Errorf("no certificates found in %q", caFile)
+	}
+
+	return ca, nil
+}
+
+// apply sets up tlsConfig to verify client certificates
+func (ca clientAuth) apply(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig.ClientAuth = ca.Type
+	tlsConfig.ClientCAs = ca.CAs
+	return tlsConfig
+}
+
+// CertificateUser returns the user that the verified client certificate of r was issued to.
+// The common name of the certificate is the user name, ok is false if there is no such user or the certificate
+// wasn't added to the user with "upduck clientcert". The CA is shared by all virtual hosts, so the common name alone
+// would be valid for users with the same name in any user file
+func (u *UserStore) CertificateUser(r *http.Request) (name string, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	name = cert.Subject.CommonName
+	if name == "" {
+		return "", false
+	}
+
+	u.umut.RLock()
+	defer u.umut.RUnlock()
+
+	usr, ok := u.Users[name]
+	if !ok {
+		return name, false
+	}
+
+	fp := certFingerprint(cert)
+	for _, c := range usr.Certificates {
+		if c.Fingerprint == fp {
+			return name, true
+		}
+	}
+
+	return name, false
+}
+
+// clientCert is a client certificate that can log in a user
+type clientCert struct {
+	// Fingerprint is the hex-encoded SHA-256 hash of the certificate
+	Fingerprint string    `json:"fingerprint"`
+	Expires     time.Time `json:"expires"`
+}
+
+// certFingerprint returns the SHA-256 fingerprint of cert
+func certFingerprint(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(h[:])
+}
+
+// normalizeFingerprint allows fingerprints in the format of "openssl x509 -fingerprint -sha256", which
+// uses upper case letters separated by colons
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
+
+// loadCertificateFile reads the first certificate from the PEM file fn
+func loadCertificateFile(fn string) (cert *x509.Certificate, err error) {
+	content, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return
+	}
+
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found in %q", fn)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// addCertificate allows cert to log in as usr. Expired certificates are removed
+func (usr *user) addCertificate(cert *x509.Certificate) {
+	now := time.Now()
+
+	var certs []clientCert
+	for _, c := range usr.Certificates {
+		if now.Before(c.Expires) {
+			certs = append(certs, c)
+		}
+	}
+
+	usr.Certificates = append(certs, clientCert{
+		Fingerprint: certFingerprint(cert),
+		Expires:     cert.NotAfter,
+	})
+}
+
+// revokeCertificate removes the certificate with the given fingerprint from usr, or all certificates if fp is empty.
+// It returns how many certificates were removed
+func (usr *user) revokeCertificate(fp string) (n int) {
+	fp = normalizeFingerprint(fp)
+
+	var certs []clientCert
+	for _, c := range usr.Certificates {
+		if fp == "" || c.Fingerprint == fp {
+			n++
+			continue
+		}
+		certs = append(certs, c)
+	}
+	usr.Certificates = certs
+
+	return
+}
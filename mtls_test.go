@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertificateUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := loadOrCreateLocalCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issue := func() *x509.Certificate {
+		cert, err := ca.issueClientCert("alice", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Leaf
+	}
+	first, second, unknown := issue(), issue(), issue()
+
+	users, _ := loadUsers(filepath.Join("testdata", "does-not-exist.json"))
+	alice := user{}
+	alice.addCertificate(first)
+	alice.addCertificate(second)
+	users.Users["alice"] = alice
+
+	// A virtual host with its own user file that also has an alice
+	other, _ := loadUsers(filepath.Join("testdata", "does-not-exist.json"))
+	other.Users["alice"] = user{}
+
+	check := func(name string, u *UserStore, cert *x509.Certificate, want bool) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+		if uname, ok := u.CertificateUser(r); ok != want || (ok && uname != "alice") {
+			t.Errorf("%s: got user %q and %v, want %v", name, uname, ok, want)
+		}
+	}
+
+	check("first certificate", users, first, true)
+	check("second certificate", users, second, true)
+	check("certificate that wasn't added", users, unknown, false)
+	check("other user file", other, first, false)
+
+	alice = users.Users["alice"]
+	if n := alice.revokeCertificate(strings.ToUpper(certFingerprint(first))); n != 1 {
+		t.Errorf("revoked %d certificates, want 1", n)
+	}
+	users.Users["alice"] = alice
+
+	check("revoked certificate", users, first, false)
+	check("certificate after revoking another one", users, second, true)
+
+	delete(users.Users, "alice")
+	users.Users["alice"] = user{}
+	check("user added again", users, second, false)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Roles define what a user is allowed to do with the files they can access
+const (
+	roleRead   = "read"   // Only download files and list directories
+	roleUpload = "upload" // Additionally upload files and create directories
+	roleAdmin  = "admin"  // Additionally delete and move files
+)
+
+// roleLevel returns a number that is higher for more powerful roles.
+// Users from older versions don't have a role, they could already do everything
+func roleLevel(role string) int {
+	switch role {
+	case roleRead:
+		return 1
+	case roleUpload:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// isValidRole returns whether role is one of the known roles
+func isValidRole(role string) bool {
+	return role == roleRead || role == roleUpload || role == roleAdmin
+}
+
+// requiredRole returns the role a user needs for sending a request with the given method
+func requiredRole(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return roleRead
+	case http.MethodPut, http.MethodPost, "MKCOL", "COPY", "LOCK", "UNLOCK", "PROPPATCH":
+		return roleUpload
+	default:
+		return roleAdmin
+	}
+}
+
+// IsAllowed returns whether the user with the given name may send the given request.
+// The paths of users are checked against root + request path, where root is the URL path of the served directory
+// in the directory the user paths refer to
+func (u *UserStore) IsAllowed(name, root string, r *http.Request) bool {
+	u.umut.RLock()
+	usr, ok := u.Users[name]
+	u.umut.RUnlock()
+	if !ok {
+		return false
+	}
+
+	if roleLevel(usr.Role) < roleLevel(requiredRole(r.Method)) {
+		return false
+	}
+
+	if !isAllowedPath(usr.Paths, userPath(root, r.URL.Path)) {
+		return false
+	}
+
+	// WebDAV requests that copy or move files also write to their destination
+	if dest := r.Header.Get("Destination"); dest != "" {
+		du, err := url.Parse(dest)
+		if err != nil || !isAllowedPath(usr.Paths, userPath(root, du.Path)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// userPath returns the path that urlPath on a host serving root has in the directory the user paths refer to.
+// Like the file server, ".." can't leave root
+func userPath(root, urlPath string) string {
+	return path.Join("/", root, path.Clean("/"+urlPath))
+}
+
+// HasPaths returns whether the user is restricted to certain directories
+func (u *UserStore) HasPaths(name string) bool {
+	u.umut.RLock()
+	defer u.umut.RUnlock()
+
+	return len(u.Users[name].Paths) != 0
+}
+
+// isAllowedPath returns whether urlPath is in one of the given directories. If there are none, all paths are allowed
+func isAllowedPath(prefixes []string, urlPath string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+
+	p := path.Clean("/" + urlPath)
+	for _, prefix := range prefixes {
+		prefix = path.Clean("/" + prefix)
+		if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsAllowedPath(t *testing.T) {
+	var tests = []struct {
+		prefixes []string
+		urlPath  string
+		want     bool
+	}{
+		{nil, "/anything", true},
+		{[]string{"/"}, "/anything", true},
+		{[]string{"/a"}, "/a", true},
+		{[]string{"/a"}, "/a/", true},
+		{[]string{"/a"}, "/a/b/c.txt", true},
+		{[]string{"/a"}, "/ab", false},
+		{[]string{"/a"}, "/ab/c.txt", false},
+		{[]string{"/a"}, "/", false},
+		{[]string{"/a"}, "/b", false},
+		{[]string{"/a"}, "/a/../b", false},
+		{[]string{"/a"}, "/a/b/../../b/c.txt", false},
+		{[]string{"/a"}, "/../a/b", true},
+		{[]string{"/a"}, "a/b", true},
+		{[]string{"a/"}, "/a/b", true},
+		{[]string{"/a/b"}, "/a", false},
+		{[]string{"/a", "/b"}, "/b/c", true},
+		{[]string{"/a", "/b"}, "/c", false},
+	}
+
+	for _, tt := range tests {
+		if got := isAllowedPath(tt.prefixes, tt.urlPath); got != tt.want {
+			t.Errorf("isAllowedPath(%q, %q) = %v, want %v", tt.prefixes, tt.urlPath, got, tt.want)
+		}
+	}
+}
+
+func TestRequiredRole(t *testing.T) {
+	var tests = []struct {
+		method string
+		want   string
+	}{
+		{http.MethodGet, roleRead},
+		{http.MethodHead, roleRead},
+		{http.MethodOptions, roleRead},
+		{"PROPFIND", roleRead},
+		{http.MethodPut, roleUpload},
+		{http.MethodPost, roleUpload},
+		{"MKCOL", roleUpload},
+		{"COPY", roleUpload},
+		{"LOCK", roleUpload},
+		{"UNLOCK", roleUpload},
+		{"PROPPATCH", roleUpload},
+		{http.MethodDelete, roleAdmin},
+		{"MOVE", roleAdmin},
+		{"UNKNOWN", roleAdmin},
+	}
+
+	for _, tt := range tests {
+		if got := requiredRole(tt.method); got != tt.want {
+			t.Errorf("requiredRole(%q) = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	users, _ := loadUsers(filepath.Join("testdata", "does-not-exist.json"))
+	users.Users["reader"] = user{Role: roleRead}
+	users.Users["uploader"] = user{Role: roleUpload, Paths: []string{"/a"}}
+	users.Users["admin"] = user{Role: roleAdmin, Paths: []string{"/a"}}
+	users.Users["legacy"] = user{}
+
+	var tests = []struct {
+		name        string
+		user        string
+		root        string
+		method      string
+		path        string
+		destination string
+		want        bool
+	}{
+		{"read", "reader", "", http.MethodGet, "/x/file.txt", "", true},
+		{"read with PROPFIND", "reader", "", "PROPFIND", "/x/", "", true},
+		{"read can't PUT", "reader", "", http.MethodPut, "/file.txt", "", false},
+		{"read can't POST", "reader", "", http.MethodPost, "/", "", false},
+		{"read can't MKCOL", "reader", "", "MKCOL", "/dir", "", false},
+		{"read can't DELETE", "reader", "", http.MethodDelete, "/file.txt", "", false},
+		{"upload PUT", "uploader", "", http.MethodPut, "/a/file.txt", "", true},
+		{"upload MKCOL", "uploader", "", "MKCOL", "/a/dir", "", true},
+		{"upload outside path", "uploader", "", http.MethodPut, "/ab/file.txt", "", false},
+		{"upload can't DELETE", "uploader", "", http.MethodDelete, "/a/file.txt", "", false},
+		{"upload COPY inside path", "uploader", "", "COPY", "/a/file.txt", "http://host/a/copy.txt", true},
+		{"upload COPY out of path", "uploader", "", "COPY", "/a/file.txt", "http://host/b/copy.txt", false},
+		{"admin MOVE inside path", "admin", "", "MOVE", "/a/file.txt", "/a/sub/file.txt", true},
+		{"admin MOVE out of path", "admin", "", "MOVE", "/a/file.txt", "http://host/b/file.txt", false},
+		{"admin MOVE with .. in destination", "admin", "", "MOVE", "/a/file.txt", "http://host/a/../b/file.txt", false},
+		{"admin MOVE with encoded .. in destination", "admin", "", "MOVE", "/a/file.txt", "http://host/a/%2e%2e/b/file.txt", false},
+		{"admin MOVE to invalid destination", "admin", "", "MOVE", "/a/file.txt", "http://host/%zz", false},
+		{"admin with .. in path", "admin", "", http.MethodGet, "/a/../b/file.txt", "", false},
+		{"legacy user without role", "legacy", "", http.MethodDelete, "/file.txt", "", true},
+		{"unknown user", "nobody", "", http.MethodGet, "/", "", false},
+
+		// A subdomain serving the directory a of the main directory
+		{"subdomain root inside path", "admin", "/a", http.MethodGet, "/file.txt", "", true},
+		{"subdomain with .. in path", "admin", "/a", http.MethodGet, "/../b/file.txt", "", true},
+		{"subdomain destination", "admin", "/a", "MOVE", "/file.txt", "http://host/sub/file.txt", true},
+		{"subdomain destination with ..", "admin", "/a", "MOVE", "/file.txt", "http://host/../b/file.txt", true},
+		{"subdomain root outside path", "admin", "/b", http.MethodGet, "/file.txt", "", false},
+		{"subdomain root with similar name", "admin", "/ab", http.MethodGet, "/file.txt", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://host/", nil)
+			r.URL.Path = tt.path
+			if tt.destination != "" {
+				r.Header.Set("Destination", tt.destination)
+			}
+
+			if got := users.IsAllowed(tt.user, tt.root, r); got != tt.want {
+				t.Errorf("IsAllowed(%q, %q, %s %s) = %v, want %v", tt.user, tt.root, tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutsideUserRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	main, other := filepath.Join(dir, "main"), filepath.Join(dir, "other")
+	for _, d := range []string{filepath.Join(main, "a"), other} {
+		err = os.MkdirAll(d, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash, err := hashPassword("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, _ := loadUsers(filepath.Join(dir, "users.json"))
+	users.Users["all"] = user{PasswordHash: hash}
+	users.Users["limited"] = user{PasswordHash: hash, Paths: []string{"/a"}}
+
+	s := &Server{BaseDir: main, UserStore: users}
+
+	var tests = []struct {
+		name string
+		dir  string
+		user string
+		want int
+	}{
+		{"subdirectory for user without paths", filepath.Join(main, "a"), "all", http.StatusOK},
+		{"subdirectory for user with its path", filepath.Join(main, "a"), "limited", http.StatusOK},
+		{"outside directory for user without paths", other, "all", http.StatusOK},
+		{"outside directory for user with paths", other, "limited", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hs, err := s.ForHost(HostConfig{Dir: tt.dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.SetBasicAuth(tt.user, "pw")
+
+			w := httptest.NewRecorder()
+			hs.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpsRedirect sends requests from outside the local network to the HTTPS server, local requests are served by Next
+type httpsRedirect struct {
+	// Domains are the domain names with a certificate, requests for other hosts are redirected to the first one
+	Domains []string
+	// Port is the external port of the HTTPS server, which is forwarded to it in the router
+	Port int
+
+	Next http.Handler
+}
+
+func (h *httpsRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || isLANAddress(net.ParseIP(host)) {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	target := "https://" + h.targetHost(r.Host)
+	if h.Port != 443 {
+		target += ":" + strconv.Itoa(h.Port)
+	}
+	target += r.URL.RequestURI()
+
+	// Unlike 301, 308 makes clients repeat uploads with the same method
+	http.Redirect(w, r, target, http.StatusPermanentRedirect)
+}
+
+// targetHost returns the host name of the HTTPS URL for a request to host
+func (h *httpsRedirect) targetHost(host string) string {
+	host = normalizeHost(host)
+
+	// Subdomains are covered by the wildcard certificate
+	for _, domain := range h.Domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return host
+		}
+	}
+
+	if len(h.Domains) > 0 {
+		return h.Domains[0]
+	}
+
+	// IPv6 addresses must be in brackets in URLs
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil && ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return host
+}
+
+// lanNetworks are address ranges that can only be used in local networks
+var lanNetworks = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+// isLANAddress returns whether ip belongs to this device or the local network
+func isLANAddress(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+
+	for _, n := range lanNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	// Devices in the local network often connect from global IPv6 addresses in our own prefix
+	for _, n := range ownNetworks() {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownNetworksTTL is how long the networks of our interfaces are cached, they change when moving to another network
+const ownNetworksTTL = 30 * time.Second
+
+var ownNetworksCache struct {
+	mut     sync.Mutex
+	nets    []*net.IPNet
+	updated time.Time
+}
+
+// ownNetworks returns the networks the interfaces of this device are in
+func ownNetworks() []*net.IPNet {
+	ownNetworksCache.mut.Lock()
+	defer ownNetworksCache.mut.Unlock()
+
+	if time.Since(ownNetworksCache.updated) > ownNetworksTTL {
+		nets, err := interfaceNetworks()
+		if err != nil {
+			log.Println("[Warning] Error while looking up local networks:", err.Error())
+		}
+		ownNetworksCache.nets = nets
+		ownNetworksCache.updated = time.Now()
+	}
+
+	return ownNetworksCache.nets
+}
+
+func mustParseCIDRs(cidrs ...string) (nets []*net.IPNet) {
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// withHSTS adds a Strict-Transport-Security header with the given policy to all responses of next
+func withHSTS(policy string, next http.Handler) http.Handler {
+	if policy == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", policy)
+		next.ServeHTTP(w, r)
+	})
+}
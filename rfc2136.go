@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+const (
+	// rfc2136TTL is the TTL of address records, it is short because our IP address might change at any time
+	rfc2136TTL = time.Minute
+
+	defaultTSIGAlgorithm = "hmac-sha256"
+)
+
+// ErrRFC2136Rejected is returned when the DNS server refuses an update, which happens if the TSIG key or zone is wrong
+var ErrRFC2136Rejected = errors.New("the DNS server rejected the update, please make sure your TSIG key and zone are correct")
+
+// RFC2136Error is returned when the DNS server answers with an unexpected response code
+type RFC2136Error struct {
+	Rcode int
+}
+
+func (e *RFC2136Error) Error() string {
+	return fmt.Sprintf("unexpected response code %s from DNS server", dns.RcodeToString[e.Rcode])
+}
+
+// rfc2136Provider updates records on an authoritative DNS server using dynamic updates (RFC 2136), signed with TSIG (RFC 2845)
+type rfc2136Provider struct {
+	server  string
+	zone    string
+	domains []string
+
+	keyName   string
+	secret    string
+	algorithm string
+
+	ipLookupURL string
+}
+
+func newRFC2136Provider(c Config) (p *rfc2136Provider, err error) {
+	if c.RFC2136Server == "" || c.RFC2136Zone == "" || len(c.Domains) == 0 {
+		return nil, errors.New("the rfc2136 DNS provider needs a server, zone and at least one domain")
+	}
+
+	p = &rfc2136Provider{
+		server:      c.RFC2136Server,
+		zone:        dns.Fqdn(strings.ToLower(c.RFC2136Zone)),
+		secret:      c.TSIGSecret,
+		ipLookupURL: c.IPLookupURL,
+	}
+
+	// The default DNS port is used if none is given
+	if _, _, err := net.SplitHostPort(p.server); err != nil {
+		p.server = net.JoinHostPort(p.server, "53")
+	}
+
+	// Names in TSIG records must be lowercase and fully qualified
+	if c.TSIGKeyName != "" {
+		if c.TSIGSecret == "" {
+			return nil, errors.New("the TSIG key needs a secret")
+		}
+		p.keyName = dns.Fqdn(strings.ToLower(c.TSIGKeyName))
+
+		alg := c.TSIGAlgorithm
+		if alg == "" {
+			alg = defaultTSIGAlgorithm
+		}
+		p.algorithm = dns.Fqdn(strings.ToLower(alg))
+	}
+
+	for _, domain := range c.Domains {
+		domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+		if !dns.IsSubDomain(p.zone, dns.Fqdn(domain)) {
+			return nil, fmt.Errorf("domain %q is not in zone %q", domain, p.zone)
+		}
+		p.domains = append(p.domains, domain)
+	}
+
+	return p, nil
+}
+
+func (p *rfc2136Provider) Name() string {
+	return "DNS server " + p.server
+}
+
+func (p *rfc2136Provider) Domains() []string {
+	return p.domains
+}
+
+// UpdateIP sets the A and AAAA records of all domains. Records that already have the right address are not touched
+func (p *rfc2136Provider) UpdateIP(ctx context.Context) (res UpdateResult, err error) {
+	// If one address is unknown, its records are left alone and only the other one is updated
+	res.IP, err = publicIPv4(ctx, p.ipLookupURL)
+
+	// Not every network has IPv6, in that case AAAA records are left alone
+	res.IPv6, _ = externalIPv6()
+
+	if res.IPv6 == "" {
+		if err == nil && res.IP == "" {
+			err = errors.New("no IPv4 or IPv6 address found")
+		}
+		if err != nil {
+			return
+		}
+	} else if err != nil {
+		log.Println("[Warning] Could not get IPv4 address, only AAAA records are updated:", err.Error())
+		err = nil
+	}
+
+	var update []dns.RR
+	for _, domain := range p.domains {
+		for _, addr := range []string{res.IP, res.IPv6} {
+			if addr == "" {
+				continue
+			}
+
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(domain), int(rfc2136TTL.Seconds()), addressType(addr), addr))
+			if err != nil {
+				return res, err
+			}
+
+			current, err := p.lookup(ctx, rr.Header().Name, rr.Header().Rrtype)
+			if err != nil {
+				return res, err
+			}
+			if len(current) == 1 && dns.IsDuplicate(current[0], rr) {
+				continue
+			}
+
+			update = append(update, rr)
+		}
+	}
+
+	if len(update) == 0 {
+		return res, nil
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(p.zone)
+	m.RemoveRRset(update)
+	m.Insert(update)
+
+	_, err = p.exchange(ctx, m)
+	if err != nil {
+		return
+	}
+
+	res.Changed = true
+	return res, nil
+}
+
+// lookup asks the server for the records of the given name and type
+func (p *rfc2136Provider) lookup(ctx context.Context, name string, rrtype uint16) (rrs []dns.RR, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, rrtype)
+
+	r, err := p.exchange(ctx, m)
+	if err != nil {
+		return
+	}
+
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == rrtype {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return
+}
+
+// exchange sends m to the server and returns its answer, updates are signed if a TSIG key is configured
+func (p *rfc2136Provider) exchange(ctx context.Context, m *dns.Msg) (r *dns.Msg, err error) {
+	client := &dns.Client{
+		Net:     "tcp",
+		Timeout: 10 * time.Second,
+	}
+
+	if p.keyName != "" && m.Opcode == dns.OpcodeUpdate {
+		client.TsigSecret = map[string]string{p.keyName: p.secret}
+		m.SetTsig(p.keyName, p.algorithm, 300, time.Now().Unix())
+	}
+
+	r, _, err = client.ExchangeContext(ctx, m, p.server)
+	if err != nil {
+		return
+	}
+
+	switch r.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		return r, nil
+	case dns.RcodeRefused, dns.RcodeNotAuth, dns.RcodeNotZone:
+		return nil, ErrRFC2136Rejected
+	default:
+		return nil, &RFC2136Error{Rcode: r.Rcode}
+	}
+}
+
+// AppendRecords adds the given records, it is used for ACME challenges
+func (p *rfc2136Provider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return recs, p.updateRecords(ctx, zone, recs, false)
+}
+
+// DeleteRecords removes the given records after an ACME challenge
+func (p *rfc2136Provider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return recs, p.updateRecords(ctx, zone, recs, true)
+}
+
+func (p *rfc2136Provider) updateRecords(ctx context.Context, zone string, recs []libdns.Record, remove bool) (err error) {
+	zone = dns.Fqdn(zone)
+
+	var rrs []dns.RR
+	for _, rec := range recs {
+		value := rec.Value
+		if rec.Type == "TXT" {
+			value = strconv.Quote(value)
+		}
+
+		ttl := rec.TTL
+		if ttl <= 0 {
+			ttl = rfc2136TTL
+		}
+
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", libdns.AbsoluteName(rec.Name, zone), int(ttl.Seconds()), rec.Type, value))
+		if err != nil {
+			return err
+		}
+		rrs = append(rrs, rr)
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	if remove {
+		m.Remove(rrs)
+	} else {
+		m.Insert(rrs)
+	}
+
+	_, err = p.exchange(ctx, m)
+	return
+}
+
+// DNS01Solver returns a solver that also asks our DNS server whether challenge records are visible, so it works
+// with servers that aren't reachable from the internet, e.g. when testing
+func (p *rfc2136Provider) DNS01Solver() *certmagic.DNS01Solver {
+	return &certmagic.DNS01Solver{
+		DNSProvider: p,
+		Resolvers:   []string{p.server},
+	}
+}
+
+// addressType returns the DNS record type for ip
+func addressType(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "AAAA"
+	}
+	return "A"
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSearchResults is the maximum number of results a search returns
+const maxSearchResults = 1000
+
+var errSearchLimit = errors.New("search result limit reached")
+
+// searchResult is a file found by a search. Its name is the slash-separated path relative to the searched directory,
+// that way it can be used like any other entry in a directory listing
+type searchResult struct {
+	os.FileInfo
+	relPath string
+}
+
+func (s searchResult) Name() string {
+	return s.relPath
+}
+
+// SearchDir returns all directories and files below directory whose name contains term (case-insensitive).
+// If more than limit entries match, only the first ones are returned and truncated is true
+func SearchDir(directory, term string, limit int, ctx context.Context) (dirs, files []os.FileInfo, truncated bool, err error) {
+	term = strings.ToLower(term)
+
+	err = filepath.Walk(directory, func(path string, f os.FileInfo, err error) error {
+		select {
+		case <-ctx.Done():
+			return errCancelled
+		default:
+		}
+
+		if err != nil {
+			// Directories we cannot read are skipped, but the searched directory itself must be readable
+			if path == directory {
+				return err
+			}
+			return nil
+		}
+
+		if path == directory || !strings.Contains(strings.ToLower(f.Name()), term) {
+			return nil
+		}
+
+		if len(dirs)+len(files) >= limit {
+			return errSearchLimit
+		}
+
+		relPath, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+
+		result := searchResult{
+			FileInfo: f,
+			relPath:  filepath.ToSlash(relPath),
+		}
+
+		if f.IsDir() {
+			dirs = append(dirs, result)
+		} else {
+			files = append(files, result)
+		}
+
+		return nil
+	})
+	if err == errSearchLimit {
+		return dirs, files, true, nil
+	}
+
+	return
+}
@@ -5,68 +5,174 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
-	"sort"
 	"strings"
+	"time"
 )
 
 type Server struct {
 	BaseDir             string
 	DisallowDirectories bool
+	AllowUploads        bool
+
+	// WebDAV is used for all requests that don't come from browsers, it is nil if WebDAV is disabled
+	WebDAV http.Handler
+
+	// ShareKey is used for signing share links and session cookies, both are disabled if it is nil
+	ShareKey []byte
+	// SessionLifetime is how long users stay logged in after using the login form
+	SessionLifetime time.Duration
+	// Downloads counts downloads of share links with a download limit
+	Downloads *DownloadCounter
+	// Logins slows down password guessing, there is no limit if it is nil
+	Logins *LoginLimiter
+
+	// UserRoot is the path of BaseDir in the directory that the paths of users refer to, e.g. "/Pictures" for a
+	// subdomain that serves a subdirectory with the normal user accounts. Empty means BaseDir itself
+	UserRoot string
+	// outsideUserRoot is true if BaseDir is not in the directory that the paths of users refer to,
+	// then only users that can access all paths are allowed
+	outsideUserRoot bool
+
+	// Template is used for directory listings instead of the built-in one if it is not nil
+	Template *template.Template
 
 	*UserStore
 }
 
 // ServeHTTP implements http.Handler by wrapping Handler with error handling and authentication
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Failed login requests are not logged
-	if s.UserStore.NeedAuth() {
-		uname, pw, ok := r.BasicAuth()
-		if !ok {
-			// We need authentication
-			w.Header().Set("WWW-Authenticate", `Basic realm="Upduck login"`)
-			w.WriteHeader(http.StatusUnauthorized)
+	// Browsers log in using a form, which isn't needed if there are no users
+	if s.UserStore.NeedAuth() && s.ShareKey != nil {
+		switch r.URL.Path {
+		case loginPath:
+			s.serveLogin(w, r)
+			return
+		case logoutPath:
+			s.serveLogout(w, r)
 			return
 		}
+	}
 
-		if !s.UserStore.IsValidUser(uname, pw) {
-			// Wrong Username/Password, try again
-			w.Header().Set("WWW-Authenticate", `Basic realm="Upduck login"`)
-			w.WriteHeader(http.StatusUnauthorized)
+	if token := r.URL.Query().Get(shareParam); token != "" && s.ShareKey != nil {
+		// Share links allow access to one path without logging in
+		link, err := parseShareLink(s.ShareKey, token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if !link.Allows(r) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
+		if link.MaxDownloads > 0 && (s.Downloads == nil || s.Downloads.Remaining(link) <= 0) {
+			http.Error(w, errDownloadsUsedUp.Error(), http.StatusGone)
+			return
+		}
+
+		// The token is not logged as anyone reading logs could use it
+		log.Printf("share link for %s: %s %s from %s\n", link.Path, r.Method, r.URL.Path, r.RemoteAddr)
 
-		log.Printf("%s: %s %s from %s\n", uname, r.Method, r.URL.String(), r.RemoteAddr)
+		r = withShareLink(r, link)
+	} else if s.UserStore.NeedAuth() {
+		// A client certificate logs in its user without a password
+		uname, ok := s.UserStore.CertificateUser(r)
+		if !ok {
+			uname, ok = s.sessionUser(r)
+			if ok {
+				r = withSessionUser(r, uname)
+			}
+		}
+		if !ok {
+			var pw string
+			uname, pw, ok = r.BasicAuth()
+			if !ok {
+				// Browsers get the login form, other clients like curl and scripts use basic auth
+				if s.ShareKey != nil && wantsLoginPage(r) {
+					redirectToLogin(w, r)
+					return
+				}
+
+				// We need authentication
+				w.Header().Set("WWW-Authenticate", `Basic realm="Upduck login"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			// Basic auth sends no code, so users with two-factor authentication must use the login form
+			if s.UserStore.HasTOTP(uname) {
+				log.Printf("[Auth] Basic auth is disabled for user %q with two-factor authentication, request from %s\n", uname, r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Basic realm="Upduck login"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			// Failed logins are logged by checkLogin
+			valid, wait := s.checkLogin(r, uname, pw, "")
+			if wait > 0 {
+				tooManyLogins(w, wait)
+				return
+			}
+			if !valid {
+				// Wrong Username/Password, try again
+				w.Header().Set("WWW-Authenticate", `Basic realm="Upduck login"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		log.Printf("%s: %s %s from %s\n", uname, r.Method, loggedURL(r), r.RemoteAddr)
+
+		// Users might only be allowed to read files or access certain directories
+		if !s.UserStore.IsAllowed(uname, s.UserRoot, r) || (s.outsideUserRoot && s.UserStore.HasPaths(uname)) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
 	} else {
 		// Normal logging
-		log.Println(r.Method, r.URL.String(), "from", r.RemoteAddr)
+		log.Println(r.Method, loggedURL(r), "from", r.RemoteAddr)
+	}
+
+	if s.WebDAV != nil && isWebDAVRequest(r) {
+		if s.DisallowDirectories && listsDirectory(r) {
+			// Listings *not* allowed, but properties of single files and directories are fine
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		s.WebDAV.ServeHTTP(w, r)
+		return
 	}
 
 	err := s.Handler(w, r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Error handling %s %s from %s: %s\n", r.Method, r.URL.String(), r.RemoteAddr, err.Error())
+		log.Printf("Error handling %s %s from %s: %s\n", r.Method, loggedURL(r), r.RemoteAddr, err.Error())
 	}
 }
 
 // Handler handles all requests
 func (s *Server) Handler(w http.ResponseWriter, r *http.Request) (err error) {
-	if r.Method != http.MethodGet {
+	// Uploads are only accepted if they have been enabled
+	var isUpload = r.Method == http.MethodPut || r.Method == http.MethodPost
+	if r.Method != http.MethodGet && !(isUpload && s.AllowUploads) {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
 
-	p := strings.TrimPrefix(r.URL.Path, "/") // e.g. "http://server:port/test.pdf" => "test.pdf"
-
-	direct := filepath.Join(s.BaseDir, p)
-
-	// Prevent urls that go back too far, e.g. someone trying to access "/../secret.pdf"
-	relPath, err := filepath.Rel(s.BaseDir, direct)
+	absPath, err := s.resolvePath(r.URL.Path)
 	if err != nil {
+		if err == errOutsideBaseDir {
+			http.NotFound(w, r)
+			return nil
+		}
 		return
 	}
 
-	absPath := filepath.Join(s.BaseDir, relPath)
+	if isUpload {
+		return s.Upload(absPath, w, r)
+	}
 
 	// Now, actually check the file
 	fi, err := os.Stat(absPath)
@@ -80,9 +186,9 @@ func (s *Server) Handler(w http.ResponseWriter, r *http.Request) (err error) {
 
 	// Handle directory listings
 	if fi.IsDir() {
-		// If a directory contains index.html, we should always serve that instead
+		// If a directory contains index.html, we should always serve that instead (except when searching)
 		indexFile := filepath.Join(absPath, "index.html")
-		if _, err := os.Stat(indexFile); err == nil {
+		if _, err := os.Stat(indexFile); err == nil && r.URL.Query().Get("search") == "" {
 			http.ServeFile(w, r, indexFile)
 			return nil
 		}
@@ -100,8 +206,31 @@ func (s *Server) Handler(w http.ResponseWriter, r *http.Request) (err error) {
 	return s.File(absPath, w, r)
 }
 
+// resolvePath returns the path on disk for the given URL path, making sure it doesn't leave s.BaseDir
+func (s *Server) resolvePath(urlPath string) (absPath string, err error) {
+	p := strings.TrimPrefix(urlPath, "/") // e.g. "http://server:port/test.pdf" => "test.pdf"
+
+	direct := filepath.Join(s.BaseDir, p)
+
+	// Prevent urls that go back too far, e.g. someone trying to access "/../secret.pdf"
+	relPath, err := filepath.Rel(s.BaseDir, direct)
+	if err != nil {
+		return
+	}
+	if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", errOutsideBaseDir
+	}
+
+	return filepath.Join(s.BaseDir, relPath), nil
+}
+
 // File serves the given file
 func (s *Server) File(filepath string, w http.ResponseWriter, r *http.Request) (err error) {
+	ok, err := s.takeDownload(w, r)
+	if !ok {
+		return
+	}
+
 	http.ServeFile(w, r, filepath)
 	return
 }
@@ -133,31 +262,86 @@ a:hover {
 .dl > a {
 	padding: 0;
 }
+table {
+	margin: 0 auto;
+	border-collapse: collapse;
+}
+td, th {
+	padding: 6px 12px;
+	text-align: left;
+}
+td.num {
+	text-align: right;
+}
+th > a {
+	padding: 0;
+}
 </style>
 
 <h2>Listing {{.Name}}</h2>
-{{if .ShowBack}}<p><a href="../">Go back</a></p>{{end}}
-<h3>Directories</h3>
-<p class="dl">You can download this directory as <a href="?format=zip">zip</a>, <a href="?format=tar">tar</a> or <a href="?format=tar.gz">tar.gz</a> file.</p> 
+{{with .User}}<form class="dl" method="post" action="` + logoutPath + `">Logged in as {{.}} <input type="submit" value="Log out"></form>{{end}}
+{{if .ShowBack}}<p><a href="../{{with .Share}}?share={{.}}{{end}}">Go back</a></p>{{end}}
+<p class="dl">You can download this directory as <a href="?format=zip{{with .Share}}&share={{.}}{{end}}">zip</a>, <a href="?format=tar{{with .Share}}&share={{.}}{{end}}">tar</a> or <a href="?format=tar.gz{{with .Share}}&share={{.}}{{end}}">tar.gz</a> file.</p> 
+<form class="dl" method="get">
+<input type="search" name="search" value="{{.Search}}" placeholder="Search in this directory">{{with .Share}}<input type="hidden" name="share" value="{{.}}">{{end}} <input type="submit" value="Search">
+</form>
+{{if .Search}}<p class="dl">Results for "{{.Search}}"{{if .Truncated}}, only the first {{.Count}} are shown{{end}}. <a href="./{{with .Share}}?share={{.}}{{end}}">Back to listing</a></p>{{end}}
+{{if .AllowUpload}}
+<form class="dl" method="post" enctype="multipart/form-data">
+<input type="file" name="file" multiple> <input type="submit" value="Upload">
+</form>
+{{end}}
+<table>
+<tr><th><a href="{{.SortQuery "name"}}">Name</a></th><th><a href="{{.SortQuery "size"}}">Size</a></th><th><a href="{{.SortQuery "mtime"}}">Modified</a></th><th>Type</th></tr>
 {{range .Dirs}}
-<p><a href="{{.Name}}/">{{.Name}}</a></p>
+<tr><td><a href="{{.Name}}/{{with $.Share}}?share={{.}}{{end}}">{{.Name}}/</a></td><td class="num">-</td><td>{{modtime .ModTime}}</td><td>Directory</td></tr>
 {{end}}
-
-{{with .Files}}
-<h3>Files</h3>
-{{range .}}
-<p><a href="{{.Name}}">{{.Name}}</a></p>
-{{end}}{{end}}
+{{range .Files}}
+<tr><td><a href="{{.Name}}{{with $.Share}}?share={{.}}{{end}}">{{.Name}}</a></td><td class="num">{{size .Size}}</td><td>{{modtime .ModTime}}</td><td>{{filetype .Name}}</td></tr>
+{{end}}
+</table>
 `
 
 type dirListing struct {
-	Name     string
-	ShowBack bool // Show link to ".."
-	Files    []os.FileInfo
-	Dirs     []os.FileInfo
+	Name        string
+	ShowBack    bool   // Show link to ".."
+	AllowUpload bool   // Show the upload form
+	Share       string // Token of the share link that must be added to all links
+	Sort        string // Field the entries are sorted by, see sortFields
+	Order       string // Either "asc" or "desc"
+	Search      string // Search term, if this is a list of search results
+	Truncated   bool   // Whether there were more search results than shown
+	User        string // Name of the user that is logged in with the login form, empty otherwise
+	Files       []os.FileInfo
+	Dirs        []os.FileInfo
 }
 
-var tmpl = template.Must(template.New("dirListing").Parse(templateText))
+var tmpl = template.Must(template.New("dirListing").Funcs(templateFuncs).Parse(templateText))
+
+// readDir returns all directories and files in dirPath
+func readDir(dirPath string) (dirs, files []os.FileInfo, err error) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	infos, err := dir.Readdir(0)
+	if err != nil {
+		return
+	}
+
+	// Put them in different lists
+	for _, f := range infos {
+		if f.IsDir() {
+			dirs = append(dirs, f)
+		} else {
+			files = append(files, f)
+		}
+	}
+
+	return
+}
 
 // Directory generates a directory listing
 func (s *Server) Directory(dirPath string, w http.ResponseWriter, r *http.Request) (err error) {
@@ -170,7 +354,17 @@ func (s *Server) Directory(dirPath string, w http.ResponseWriter, r *http.Reques
 		w.Header().Set("Cache-Control", "public")
 	}
 
-	switch strings.ToUpper(r.URL.Query().Get("format")) {
+	format := strings.ToUpper(r.URL.Query().Get("format"))
+
+	// Archive downloads count towards the download limit of share links
+	if format == "ZIP" || format == "TAR" || format == "TAR.GZ" {
+		ok, err := s.takeDownload(w, r)
+		if !ok {
+			return err
+		}
+	}
+
+	switch format {
 	case "ZIP":
 		setDownloadHeaders("zip", "application/zip")
 		return GenerateZIPFromDir(w, dirPath, r.Context())
@@ -181,48 +375,62 @@ func (s *Server) Directory(dirPath string, w http.ResponseWriter, r *http.Reques
 		setDownloadHeaders("tar.gz", "application/gzip")
 		return GenerateTARGZFromDir(w, dirPath, r.Context())
 	default:
-		dir, err := os.Open(dirPath)
-		if err != nil {
-			return err
+		var (
+			dirs, files []os.FileInfo
+			truncated   bool
+			search      = r.URL.Query().Get("search")
+		)
+
+		// List everything in the given directory, or everything below it that matches the search term
+		if search != "" {
+			dirs, files, truncated, err = SearchDir(dirPath, search, maxSearchResults, r.Context())
+		} else {
+			dirs, files, err = readDir(dirPath)
 		}
-		defer dir.Close()
-
-		// List everything in the given directory
-		infos, err := dir.Readdir(0)
 		if err != nil {
 			return err
 		}
 
-		var dirs, files []os.FileInfo
+		// Sort everything alphabetically, unless something else was requested. Directories always stay on top
+		sortBy, order := parseSortQuery(r)
+		sortFileInfos(dirs, sortBy, order)
+		sortFileInfos(files, sortBy, order)
 
-		// Put them in different lists
-		for _, f := range infos {
-			if f.IsDir() {
-				dirs = append(dirs, f)
-			} else {
-				files = append(files, f)
-			}
+		// If we serve the main directory, we don't show the go back link
+		var showBack = filepath.Clean(s.BaseDir) != filepath.Clean(dirPath)
+
+		// Visitors using a share link must stay in the shared directory
+		var share string
+		if link, ok := shareLinkFromRequest(r); ok {
+			share = link.Token
+			showBack = showBack && path.Clean("/"+r.URL.Path) != link.Path
 		}
 
-		// Sort everything alphabetically
-		sort.Slice(dirs, func(i, j int) bool {
-			return dirs[i].Name() < dirs[j].Name()
-		})
+		listing := dirListing{
+			Name:        filepath.Base(dirPath),
+			ShowBack:    showBack,
+			AllowUpload: s.AllowUploads && share == "",
+			Share:       share,
+			Sort:        sortBy,
+			Order:       order,
+			Search:      search,
+			Truncated:   truncated,
+			User:        sessionUserFromRequest(r),
+			Files:       files,
+			Dirs:        dirs,
+		}
 
-		sort.Slice(files, func(i, j int) bool {
-			return files[i].Name() < files[j].Name()
-		})
+		// Scripts can get the listing as JSON instead of HTML
+		if format == "JSON" || acceptsJSON(r) {
+			return writeJSONListing(w, r, listing)
+		}
 
-		// If we serve the main directory, we don't show the go back link
-		var showBack = filepath.Clean(s.BaseDir) != filepath.Clean(dirPath)
+		t := tmpl
+		if s.Template != nil {
+			t = s.Template
+		}
 
-		dirBase := filepath.Base(dirPath)
 		w.Header().Set("Content-Type", "text/html")
-		return tmpl.Execute(w, dirListing{
-			Name:     dirBase,
-			ShowBack: showBack,
-			Files:    files,
-			Dirs:     dirs,
-		})
+		return t.Execute(w, listing)
 	}
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "upduck_session"
+
+	loginPath  = "/login"
+	logoutPath = "/logout"
+
+	defaultSessionLifetime = 7 * 24 * time.Hour
+)
+
+var errInvalidSession = errors.New("invalid session")
+
+// newSessionToken returns a signed cookie value that logs in uname until it expires.
+// It contains a fingerprint of the password hash, so changing the password or deleting the user ends all sessions
+func newSessionToken(key []byte, uname, fingerprint string, expires time.Time) string {
+	payload := uname + "\n" + strconv.FormatInt(expires.Unix(), 10) + "\n" + fingerprint
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signSessionPayload(key, payload))
+}
+
+// parseSessionToken verifies the signature and expiry of token
+func parseSessionToken(key []byte, token string) (uname, fingerprint string, err error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", "", errInvalidSession
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", errInvalidSession
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", errInvalidSession
+	}
+
+	if !hmac.Equal(sig, signSessionPayload(key, string(payload))) {
+		return "", "", errInvalidSession
+	}
+
+	fields := strings.Split(string(payload), "\n")
+	if len(fields) != 3 {
+		return "", "", errInvalidSession
+	}
+
+	exp, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().After(time.Unix(exp, 0)) {
+		return "", "", errInvalidSession
+	}
+
+	return fields[0], fields[2], nil
+}
+
+// signSessionPayload returns the signature for the payload of a session cookie. The key is shared with share links,
+// the prefix makes sure that a share link token can never be used as session and vice versa
+func signSessionPayload(key []byte, payload string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("session\n" + payload))
+	return m.Sum(nil)
+}
+
+// passwordFingerprint returns a short value that changes whenever the password or TOTP secret of the user changes
+// or the user logs out
+func (u *UserStore) passwordFingerprint(name string) (fp string, ok bool) {
+	u.umut.RLock()
+	defer u.umut.RUnlock()
+
+	usr, ok := u.Users[name]
+	if !ok {
+		return "", false
+	}
+
+	secret := usr.PasswordHash
+	if usr.TOTPSecret != "" {
+		// Enabling two-factor authentication ends sessions that were started without it
+		secret += "\n" + usr.TOTPSecret
+	}
+	if usr.SessionGeneration != 0 {
+		secret += "\n" + strconv.Itoa(usr.SessionGeneration)
+	}
+
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8]), true
+}
+
+// EndSessions logs out the given user on all devices
+func (u *UserStore) EndSessions(name string) (err error) {
+	u.umut.Lock()
+	usr, ok := u.Users[name]
+	if !ok {
+		u.umut.Unlock()
+		return nil
+	}
+	usr.SessionGeneration++
+	u.Users[name] = usr
+	u.umut.Unlock()
+
+	return u.Save()
+}
+
+// sessionUser returns the user that is logged in with the session cookie of r
+func (s *Server) sessionUser(r *http.Request) (uname string, ok bool) {
+	if s.ShareKey == nil {
+		return "", false
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	uname, fingerprint, err := parseSessionToken(s.ShareKey, cookie.Value)
+	if err != nil {
+		return "", false
+	}
+
+	current, ok := s.UserStore.passwordFingerprint(uname)
+	if !ok || !hmac.Equal([]byte(current), []byte(fingerprint)) {
+		return "", false
+	}
+
+	return uname, true
+}
+
+// wantsLoginPage returns whether r comes from a browser that should see the login form instead of a basic auth prompt
+func wantsLoginPage(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// redirectToLogin sends the browser to the login form, which returns to the current page afterwards
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, loginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+}
+
+// safeRedirectTarget returns next if it is a path on this server, else the root directory.
+// Without this check, links to the login form could send users to other websites after logging in
+func safeRedirectTarget(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// serveLogin shows the login form and logs in users that submit it
+func (s *Server) serveLogin(w http.ResponseWriter, r *http.Request) {
+	data := loginPage{
+		Next:     safeRedirectTarget(r.URL.Query().Get("next")),
+		ShowCode: s.UserStore.anyTOTP(),
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		// Already logged in users don't need to see the form again
+		if _, ok := s.sessionUser(r); ok {
+			http.Redirect(w, r, data.Next, http.StatusSeeOther)
+			return
+		}
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+
+		uname, passwd := r.PostFormValue("username"), r.PostFormValue("password")
+		data.Next = safeRedirectTarget(r.PostFormValue("next"))
+		data.Username = uname
+
+		valid, wait := s.checkLogin(r, uname, passwd, r.PostFormValue("code"))
+		if wait > 0 {
+			data.Error = "Too many failed logins, please try again in " + wait.Round(time.Second).String()
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Retry-After", retryAfterSeconds(wait))
+			w.WriteHeader(http.StatusTooManyRequests)
+			loginTmpl.Execute(w, data)
+			return
+		}
+
+		if valid {
+			if fingerprint, ok := s.UserStore.passwordFingerprint(uname); ok {
+				s.startSession(w, r, uname, fingerprint)
+				log.Printf("%s logged in from %s\n", uname, r.RemoteAddr)
+
+				http.Redirect(w, r, data.Next, http.StatusSeeOther)
+				return
+			}
+		}
+
+		data.Error = "Wrong username or password"
+		if data.ShowCode {
+			data.Error = "Wrong username, password or code"
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		loginTmpl.Execute(w, data)
+		return
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	loginTmpl.Execute(w, data)
+}
+
+// startSession sets the session cookie for uname
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, uname, fingerprint string) {
+	lifetime := s.SessionLifetime
+	if lifetime <= 0 {
+		lifetime = defaultSessionLifetime
+	}
+	expires := time.Now().Add(lifetime)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    newSessionToken(s.ShareKey, uname, fingerprint, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// serveLogout ends all sessions of the logged in user and deletes the session cookie. Only POST requests are accepted,
+// else any website could log out users by embedding the logout URL as image
+func (s *Server) serveLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The cookie is signed, so just deleting it would leave a copy valid until it expires
+	if uname, ok := s.sessionUser(r); ok {
+		err := s.UserStore.EndSessions(uname)
+		if err != nil {
+			log.Printf("[Warning] Could not end sessions of user %q: %s\n", uname, err.Error())
+		} else {
+			log.Printf("%s logged out from %s\n", uname, r.RemoteAddr)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, loginPath, http.StatusSeeOther)
+}
+
+type sessionContextKey struct{}
+
+// withSessionUser returns a request that remembers uname is logged in with a session
+func withSessionUser(r *http.Request, uname string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, uname))
+}
+
+// sessionUserFromRequest returns the name of the user that is logged in with a session, if any
+func sessionUserFromRequest(r *http.Request) (uname string) {
+	uname, _ = r.Context().Value(sessionContextKey{}).(string)
+	return
+}
+
+type loginPage struct {
+	Username string
+	Next     string
+	Error    string
+	// ShowCode is true if any user has two-factor authentication
+	ShowCode bool
+}
+
+var loginTmpl = template.Must(template.New("login").Parse(loginTemplateText))
+
+// the login page looks like the built-in directory listing
+const loginTemplateText = `
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1" />
+<title>Login</title>
+<style>
+html, body {
+	background-color: #1a1a1a;
+	color: #ccc;
+}
+body {
+	margin: 0 auto;
+	text-align: center;
+	font-size: 1.25em;
+}
+input {
+	font-size: 1em;
+	margin: 6px;
+}
+.error {
+	color: #e44;
+}
+</style>
+
+<h2>Login</h2>
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+<form method="post" action="` + loginPath + `">
+<input type="hidden" name="next" value="{{.Next}}">
+<input type="text" name="username" value="{{.Username}}" placeholder="Username" autocomplete="username" required autofocus><br>
+<input type="password" name="password" placeholder="Password" autocomplete="current-password" required><br>
+{{if .ShowCode}}<input type="text" name="code" placeholder="Code (if enabled)" inputmode="numeric" autocomplete="one-time-code"><br>{{end}}
+<input type="submit" value="Log in">
+</form>
+`
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSessionToken(t *testing.T) {
+	key := []byte(strings.Repeat("k", signingKeySize))
+	later := time.Now().Add(time.Hour)
+
+	valid := newSessionToken(key, "alice", "fp", later)
+	sig := valid[strings.Index(valid, ".")+1:]
+	forged := base64.RawURLEncoding.EncodeToString([]byte("admin\n9999999999\nfp")) + "." + sig
+
+	share, err := newShareLink(key, "alice", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name     string
+		token    string
+		wantUser string
+		wantErr  error
+	}{
+		{"valid", valid, "alice", nil},
+		{"expired", newSessionToken(key, "alice", "fp", time.Now().Add(-time.Second)), "", errInvalidSession},
+		{"other key", newSessionToken([]byte(strings.Repeat("o", signingKeySize)), "alice", "fp", later), "", errInvalidSession},
+		{"forged user", forged, "", errInvalidSession},
+		{"share link", share.Token, "", errInvalidSession},
+		{"no signature", strings.SplitN(valid, ".", 2)[0], "", errInvalidSession},
+		{"empty", "", "", errInvalidSession},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uname, _, err := parseSessionToken(key, tt.token)
+			if err != tt.wantErr || uname != tt.wantUser {
+				t.Errorf("got user %q and error %v, want %q and %v", uname, err, tt.wantUser, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSessionUserPasswordChange(t *testing.T) {
+	users, _ := loadUsers(filepath.Join("testdata", "does-not-exist.json"))
+	users.Users["alice"] = user{PasswordHash: "$2a$10$first"}
+
+	s := &Server{
+		ShareKey:  []byte(strings.Repeat("k", signingKeySize)),
+		UserStore: users,
+	}
+
+	fp, _ := users.passwordFingerprint("alice")
+	cookie := &http.Cookie{Name: sessionCookieName, Value: newSessionToken(s.ShareKey, "alice", fp, time.Now().Add(time.Hour))}
+
+	check := func(name string, want bool) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookie)
+
+		if _, ok := s.sessionUser(r); ok != want {
+			t.Errorf("%s: session valid = %v, want %v", name, ok, want)
+		}
+	}
+
+	check("same password", true)
+
+	users.Users["alice"] = user{PasswordHash: "$2a$10$first", TOTPSecret: rfcSecret}
+	check("TOTP enabled", false)
+
+	users.Users["alice"] = user{PasswordHash: "$2a$10$first", SessionGeneration: 1}
+	check("logged out", false)
+
+	users.Users["alice"] = user{PasswordHash: "$2a$10$second"}
+	check("password changed", false)
+
+	delete(users.Users, "alice")
+	check("user deleted", false)
+}
+
+func TestLogout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	users, _ := loadUsers(filepath.Join(dir, "users.json"))
+	users.Users["alice"] = user{PasswordHash: "$2a$10$first"}
+
+	s := &Server{
+		ShareKey:  []byte(strings.Repeat("k", signingKeySize)),
+		UserStore: users,
+	}
+
+	fp, _ := users.passwordFingerprint("alice")
+	cookie := &http.Cookie{Name: sessionCookieName, Value: newSessionToken(s.ShareKey, "alice", fp, time.Now().Add(time.Hour))}
+
+	request := func(method string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, logoutPath, nil)
+		r.AddCookie(cookie)
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	loggedIn := func() bool {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookie)
+
+		_, ok := s.sessionUser(r)
+		return ok
+	}
+
+	// Links and images on other websites must not log out users
+	if w := request(http.MethodGet); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if !loggedIn() {
+		t.Fatal("session ended after a GET request")
+	}
+
+	if w := request(http.MethodPost); w.Code != http.StatusSeeOther {
+		t.Errorf("POST returned status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if loggedIn() {
+		t.Error("the old session cookie is still valid after logging out")
+	}
+
+	// The logout must also hold after a restart
+	reloaded, err := loadUsers(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Users["alice"].SessionGeneration != 1 {
+		t.Errorf("got session generation %d after reloading, want 1", reloaded.Users["alice"].SessionGeneration)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shareParam is the query parameter that contains the token of a share link
+const shareParam = "share"
+
+var (
+	errInvalidShare = errors.New("invalid share link")
+	errExpiredShare = errors.New("share link has expired")
+)
+
+// shareLink allows accessing Path (and everything below it) without logging in until it Expires
+type shareLink struct {
+	Path    string
+	Expires time.Time
+
+	// If MaxDownloads is not zero, the link can only be used for that many downloads.
+	// These are counted by a DownloadCounter using ID
+	MaxDownloads int
+	ID           string
+
+	// Token is the signed representation of this link
+	Token string
+}
+
+// newShareLink creates a signed share link for urlPath that is valid for the given duration and number of downloads (0 means unlimited)
+func newShareLink(key []byte, urlPath string, valid time.Duration, maxDownloads int) (l shareLink, err error) {
+	l = shareLink{
+		Path:         path.Clean("/" + urlPath),
+		Expires:      time.Now().Add(valid),
+		MaxDownloads: maxDownloads,
+	}
+
+	payload := l.Path + "\n" + strconv.FormatInt(l.Expires.Unix(), 10)
+
+	// Limited links need an ID for counting their downloads
+	if maxDownloads > 0 {
+		var id = make([]byte, 8)
+		_, err = rand.Read(id)
+		if err != nil {
+			return
+		}
+		l.ID = hex.EncodeToString(id)
+
+		payload += "\n" + strconv.Itoa(l.MaxDownloads) + "\n" + l.ID
+	}
+
+	l.Token = base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signSharePayload(key, payload))
+
+	return l, nil
+}
+
+// parseShareLink verifies the signature of token and returns the link it represents
+func parseShareLink(key []byte, token string) (l shareLink, err error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return l, errInvalidShare
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return l, errInvalidShare
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return l, errInvalidShare
+	}
+
+	if !hmac.Equal(sig, signSharePayload(key, string(payload))) {
+		return l, errInvalidShare
+	}
+
+	// Links without download limit only contain path and expiry
+	fields := strings.Split(string(payload), "\n")
+	if len(fields) != 2 && len(fields) != 4 {
+		return l, errInvalidShare
+	}
+
+	exp, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return l, errInvalidShare
+	}
+
+	l = shareLink{
+		Path:    fields[0],
+		Expires: time.Unix(exp, 0),
+		Token:   token,
+	}
+
+	if len(fields) == 4 {
+		l.MaxDownloads, err = strconv.Atoi(fields[2])
+		if err != nil || l.MaxDownloads <= 0 {
+			return l, errInvalidShare
+		}
+		l.ID = fields[3]
+	}
+
+	if time.Now().After(l.Expires) {
+		return l, errExpiredShare
+	}
+
+	return l, nil
+}
+
+// signSharePayload returns the signature for the payload of a share link
+func signSharePayload(key []byte, payload string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("share\n" + payload))
+	return m.Sum(nil)
+}
+
+// URL returns the complete link for the server reachable at baseURL
+func (l shareLink) URL(baseURL string, isDir bool) string {
+	p := (&url.URL{Path: l.Path}).EscapedPath()
+	if isDir && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+
+	return strings.TrimSuffix(baseURL, "/") + p + "?" + shareParam + "=" + l.Token
+}
+
+// Allows returns whether the link can be used for the given request. Share links only allow reading files
+func (l shareLink) Allows(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	return isAllowedPath([]string{l.Path}, r.URL.Path)
+}
+
+// loggedURL returns the URL of r for logs. Tokens of share links are left out, anyone reading the logs could use them
+func loggedURL(r *http.Request) string {
+	if r.URL.Query().Get(shareParam) != "" {
+		return r.URL.Path
+	}
+	return r.URL.String()
+}
+
+type shareContextKey struct{}
+
+// withShareLink returns a request that remembers it was authorized by l
+func withShareLink(r *http.Request, l shareLink) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), shareContextKey{}, l))
+}
+
+// shareLinkFromRequest returns the share link that authorized r, if any
+func shareLinkFromRequest(r *http.Request) (l shareLink, ok bool) {
+	l, ok = r.Context().Value(shareContextKey{}).(shareLink)
+	return
+}
+
+// signingKeySize is the length of the key for share links and session cookies in bytes
+const signingKeySize = 32
+
+// loadSigningKey loads the key used for signing links from the given file, or generates it if it doesn't exist yet.
+// An empty or damaged file is an error, a short key would allow anyone to create share links
+func loadSigningKey(keyPath string) (key []byte, err error) {
+	content, err := ioutil.ReadFile(keyPath)
+	if err == nil {
+		key, err = hex.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key in %q: %s", keyPath, err.Error())
+		}
+		if len(key) != signingKeySize {
+			return nil, fmt.Errorf("invalid key in %q: must be %d bytes, but is %d bytes", keyPath, signingKeySize, len(key))
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return
+	}
+
+	key = make([]byte, signingKeySize)
+	_, err = rand.Read(key)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(keyPath), 0755)
+	if err != nil {
+		return
+	}
+
+	return key, ioutil.WriteFile(keyPath, []byte(hex.EncodeToString(key)), 0600)
+}
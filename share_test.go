@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseShareLink(t *testing.T) {
+	key := []byte(strings.Repeat("k", signingKeySize))
+
+	valid, err := newShareLink(key, "dir/file.txt", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited, err := newShareLink(key, "dir", time.Hour, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := newShareLink(key, "dir/file.txt", -time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := newShareLink([]byte(strings.Repeat("o", signingKeySize)), "dir/file.txt", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token for "/" with the signature of the valid link
+	sig := valid.Token[strings.Index(valid.Token, ".")+1:]
+	rootPayload := "/\n" + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	forged := base64.RawURLEncoding.EncodeToString([]byte(rootPayload)) + "." + sig
+
+	// A session cookie is signed with the same key, but must not work as share link
+	session := newSessionToken(key, "/", "fp", time.Now().Add(time.Hour))
+
+	var tests = []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", valid.Token, nil},
+		{"limited", limited.Token, nil},
+		{"expired", expired.Token, errExpiredShare},
+		{"other key", otherKey.Token, errInvalidShare},
+		{"forged path", forged, errInvalidShare},
+		{"session cookie", session, errInvalidShare},
+		{"no signature", strings.SplitN(valid.Token, ".", 2)[0], errInvalidShare},
+		{"empty signature", strings.SplitN(valid.Token, ".", 2)[0] + ".", errInvalidShare},
+		{"not base64", "!!!.???", errInvalidShare},
+		{"empty", "", errInvalidShare},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseShareLink(key, tt.token)
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	l, err := parseShareLink(key, limited.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Path != "/dir" || l.MaxDownloads != 3 || l.ID != limited.ID || l.ID == "" {
+		t.Errorf("parsed link %+v doesn't match created link %+v", l, limited)
+	}
+}
+
+func TestShareLinkAllows(t *testing.T) {
+	l := shareLink{Path: "/dir"}
+
+	var tests = []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{http.MethodGet, "/dir", true},
+		{http.MethodGet, "/dir/", true},
+		{http.MethodGet, "/dir/sub/file.txt", true},
+		{http.MethodHead, "/dir/file.txt", true},
+		{http.MethodGet, "/", false},
+		{http.MethodGet, "/directory", false},
+		{http.MethodGet, "/other/file.txt", false},
+		{http.MethodGet, "/dir/../other/file.txt", false},
+		{http.MethodPut, "/dir/file.txt", false},
+		{http.MethodDelete, "/dir/file.txt", false},
+		{"PROPFIND", "/dir", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://host/", nil)
+		r.URL.Path = tt.path
+
+		if got := l.Allows(r); got != tt.want {
+			t.Errorf("Allows(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestShareLinkOtherHost(t *testing.T) {
+	key := []byte(strings.Repeat("k", signingKeySize))
+
+	l, err := newShareLink(key, "a", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = parseShareLink(hostSigningKey(key, "/srv/other"), l.Token)
+	if err != errInvalidShare {
+		t.Errorf("link of the main directory is valid for a virtual host, got error %v", err)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "new.key")
+	key, err := loadSigningKey(keyPath)
+	if err != nil || len(key) != signingKeySize {
+		t.Fatalf("creating key: got %d bytes and error %v", len(key), err)
+	}
+
+	loaded, err := loadSigningKey(keyPath)
+	if err != nil || string(loaded) != string(key) {
+		t.Fatalf("loading key: got error %v, key changed: %v", err, string(loaded) != string(key))
+	}
+
+	var invalid = map[string]string{
+		"empty":      "",
+		"whitespace": "\n",
+		"short":      "abcd",
+		"not hex":    strings.Repeat("x", 2*signingKeySize),
+		"too long":   strings.Repeat("ab", signingKeySize+1),
+	}
+
+	for name, content := range invalid {
+		fn := filepath.Join(dir, strings.ReplaceAll(name, " ", "-")+".key")
+		err = ioutil.WriteFile(fn, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := loadSigningKey(fn)
+		if err == nil || key != nil {
+			t.Errorf("%s key file: got %d bytes and error %v, want an error", name, len(key), err)
+		}
+	}
+}
+
+func TestLoggedURL(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/dir/file.txt?share=secret-token&x=1", nil)
+	if got := loggedURL(r); strings.Contains(got, "secret-token") {
+		t.Errorf("loggedURL returned %q, which contains the token", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/dir/?sort=size", nil)
+	if got := loggedURL(r); got != "/dir/?sort=size" {
+		t.Errorf("loggedURL returned %q, want the complete URL", got)
+	}
+}
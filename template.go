@@ -0,0 +1,31 @@
+package main
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path"
+)
+
+// assetsPrefix is the URL path static files for custom templates are served from
+const assetsPrefix = "/.upduck-assets/"
+
+// assetURL returns the URL of a file in the assets directory, e.g. "style.css" => "/.upduck-assets/style.css"
+func assetURL(name string) string {
+	return assetsPrefix + path.Clean("/" + name)[1:]
+}
+
+// loadTemplate parses a user-supplied directory listing template. It has access to the same data and functions as the built-in one
+func loadTemplate(templatePath string) (*template.Template, error) {
+	content, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return template.New("dirListing").Funcs(templateFuncs).Parse(string(content))
+}
+
+// assetsHandler serves static files like stylesheets and icons for custom templates from dir
+func assetsHandler(dir string) http.Handler {
+	return http.StripPrefix(assetsPrefix, http.FileServer(http.Dir(dir)))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+
+	// totpSkew is how many periods a code may be early or late, the clocks of phones are not always exact
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random secret for authenticator apps, encoded as base32 like in otpauth URIs
+func newTOTPSecret() (secret string, err error) {
+	key := make([]byte, 20)
+
+	_, err = rand.Read(key)
+	if err != nil {
+		return
+	}
+
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// totpCode returns the code for the given time step as defined in RFC 6238
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	m := hmac.New(sha1.New, key)
+	m.Write(msg[:])
+	sum := m.Sum(nil)
+
+	// Dynamic truncation from RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTOTP returns the time step code belongs to if it is valid for secret at time t
+func matchTOTP(secret, code string, t time.Time) (step int64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return 0, false
+	}
+
+	// Some apps show codes as "123 456"
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	now := t.Unix() / totpPeriod
+	for step = now - totpSkew; step <= now+totpSkew; step++ {
+		if constantTimeEquals(totpCode(key, step), code) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpURI returns an otpauth URI that can be added to authenticator apps, usually by scanning it as QR code
+func totpURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+
+	// Some apps show "+" instead of spaces in the issuer
+	query := strings.ReplaceAll(v.Encode(), "+", "%20")
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query
+}
+
+// HasTOTP returns whether the user must enter a code from an authenticator app when logging in
+func (u *UserStore) HasTOTP(name string) bool {
+	u.umut.RLock()
+	defer u.umut.RUnlock()
+
+	return u.Users[name].TOTPSecret != ""
+}
+
+// anyTOTP returns whether any user has two-factor authentication
+func (u *UserStore) anyTOTP() bool {
+	u.umut.RLock()
+	defer u.umut.RUnlock()
+
+	for _, usr := range u.Users {
+		if usr.TOTPSecret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckTOTP returns whether code is valid for the user, users without two-factor authentication don't need a code.
+// Every code can only be used once, so a code that was seen by someone else is useless to them
+func (u *UserStore) CheckTOTP(name, code string) bool {
+	u.umut.Lock()
+
+	usr, ok := u.Users[name]
+	if !ok {
+		u.umut.Unlock()
+		return false
+	}
+	if usr.TOTPSecret == "" {
+		u.umut.Unlock()
+		return true
+	}
+
+	step, ok := matchTOTP(usr.TOTPSecret, code, time.Now())
+	if !ok || step <= usr.TOTPStep {
+		u.umut.Unlock()
+		return false
+	}
+
+	usr.TOTPStep = step
+	u.Users[name] = usr
+	u.umut.Unlock()
+
+	// The step must survive a restart, else the code could be used again
+	err := u.Save()
+	if err != nil {
+		log.Printf("[Warning] Could not save last TOTP code of user %q: %s\n", name, err.Error())
+	}
+
+	return true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key from the test vectors in RFC 6238, appendix B
+var rfcSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestMatchTOTP(t *testing.T) {
+	var tests = []struct {
+		name   string
+		secret string
+		code   string
+		time   int64
+		want   bool
+	}{
+		// The RFC uses 8 digits, the last 6 of them are our code
+		{"RFC 6238 59", rfcSecret, "287082", 59, true},
+		{"RFC 6238 1111111109", rfcSecret, "081804", 1111111109, true},
+		{"RFC 6238 1111111111", rfcSecret, "050471", 1111111111, true},
+		{"RFC 6238 1234567890", rfcSecret, "005924", 1234567890, true},
+		{"RFC 6238 2000000000", rfcSecret, "279037", 2000000000, true},
+		{"RFC 6238 20000000000", rfcSecret, "353130", 20000000000, true},
+
+		{"with space", rfcSecret, "287 082", 59, true},
+		{"one period late", rfcSecret, "287082", 59 + totpPeriod, true},
+		{"one period early", rfcSecret, "287082", 59 - totpPeriod, true},
+		{"two periods late", rfcSecret, "287082", 59 + 2*totpPeriod, false},
+		{"wrong code", rfcSecret, "287083", 59, false},
+		{"8 digits", rfcSecret, "94287082", 59, false},
+		{"empty code", rfcSecret, "", 59, false},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", 59, true},
+		{"invalid secret", "not base32!", "287082", 59, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := matchTOTP(tt.secret, tt.code, time.Unix(tt.time, 0))
+			if ok != tt.want {
+				t.Errorf("matchTOTP(%q, %q, %d) = %v, want %v", tt.secret, tt.code, tt.time, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTOTPReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u, _ := loadUsers(filepath.Join(dir, "users.json"))
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Users["alice"] = user{TOTPSecret: secret}
+	u.Users["bob"] = user{}
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Codes of the next period are still valid if the test runs at the end of a period
+	now := time.Now().Unix() / totpPeriod
+
+	var tests = []struct {
+		name  string
+		user  string
+		code  string
+		valid bool
+	}{
+		{"current code", "alice", totpCode(key, now), true},
+		{"current code again", "alice", totpCode(key, now), false},
+		{"next code", "alice", totpCode(key, now+1), true},
+		{"next code again", "alice", totpCode(key, now+1), false},
+		{"older code after newer one", "alice", totpCode(key, now), false},
+		{"code from the future", "alice", totpCode(key, now+100), false},
+		{"user without secret", "bob", "", true},
+		{"unknown user", "carol", totpCode(key, now+1), false},
+	}
+
+	for _, tt := range tests {
+		if ok := u.CheckTOTP(tt.user, tt.code); ok != tt.valid {
+			t.Errorf("%s: CheckTOTP(%q, %q) = %v, want %v", tt.name, tt.user, tt.code, ok, tt.valid)
+		}
+	}
+
+	// Used codes must stay invalid after a restart
+	reloaded, err := loadUsers(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.CheckTOTP("alice", totpCode(key, now+1)) {
+		t.Error("a used code is valid again after loading the user file")
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("user file has mode %s, want %s", fi.Mode().Perm(), os.FileMode(0600))
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	got := totpURI("my site", "alice", rfcSecret)
+	want := "otpauth://totp/my%20site:alice?algorithm=SHA1&digits=6&issuer=my%20site&period=30&secret=" + rfcSecret
+
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
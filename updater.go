@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// networkCheckInterval is how often we look for changed network addresses
+	networkCheckInterval = 30 * time.Second
+	// minRetryDelay is the delay after the first failed update, it doubles with every failure
+	minRetryDelay = 30 * time.Second
+)
+
+// DNSUpdater keeps the IP address of the domains of a DNS provider up to date
+type DNSUpdater struct {
+	Provider DNSProvider
+
+	// Interval is the time between two updates, zero disables periodic updates.
+	// Updates also happen when the network addresses of this device change
+	Interval time.Duration
+
+	// LastResult is the result of the update at startup, it is used for noticing IP changes
+	LastResult UpdateResult
+}
+
+// Run updates the IP address until ctx is cancelled. It should be called after the initial update at startup
+func (u *DNSUpdater) Run(ctx context.Context) {
+	var (
+		retryDelay time.Duration
+		lastAddrs  = networkAddresses()
+		last       = u.LastResult
+
+		netTicker = time.NewTicker(networkCheckInterval)
+		timer     = time.NewTimer(u.Interval)
+	)
+	defer netTicker.Stop()
+	defer timer.Stop()
+
+	if u.Interval <= 0 && !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-netTicker.C:
+			addrs := networkAddresses()
+			if addrs == lastAddrs {
+				continue
+			}
+			log.Printf("Network addresses changed from [%s] to [%s], updating %s\n", lastAddrs, addrs, u.Provider.Name())
+			lastAddrs = addrs
+
+			// Stop the timer, it's reset below
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		res, err := u.Provider.UpdateIP(ctx)
+		if err != nil {
+			// Retry with exponential backoff, but at least as often as normal updates
+			if retryDelay == 0 {
+				retryDelay = minRetryDelay
+			} else {
+				retryDelay *= 2
+			}
+			if u.Interval > 0 && retryDelay > u.Interval {
+				retryDelay = u.Interval
+			}
+
+			log.Printf("[Warning] Error while telling %s our IP address, retrying in %s: %s\n", u.Provider.Name(), retryDelay, err.Error())
+			timer.Reset(retryDelay)
+			continue
+		}
+
+		if res.IP != last.IP || res.IPv6 != last.IPv6 {
+			log.Printf("%s now has the IP address %s for your domain\n", u.Provider.Name(), res.String())
+			last = res
+		}
+
+		retryDelay = 0
+		if u.Interval > 0 {
+			timer.Reset(u.Interval)
+		}
+	}
+}
+
+// networkAddresses returns all addresses of network interfaces that are up, except loopback ones
+func networkAddresses() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		ifAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifAddrs {
+			addrs = append(addrs, addr.String())
+		}
+	}
+
+	sort.Strings(addrs)
+	return strings.Join(addrs, " ")
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var errOutsideBaseDir = errors.New("path is outside of the served directory")
+
+// Upload handles PUT and POST requests that write files into the served directory.
+// PUT requests write their raw body to the given path, while POST requests to a directory
+// contain a multipart form (e.g. from the directory listing) with any number of "file" fields
+func (s *Server) Upload(absPath string, w http.ResponseWriter, r *http.Request) (err error) {
+	if r.Method == http.MethodPut {
+		return s.putFile(absPath, w, r)
+	}
+
+	return s.postFiles(absPath, w, r)
+}
+
+// putFile writes the request body to filePath, replacing any existing file
+func (s *Server) putFile(filePath string, w http.ResponseWriter, r *http.Request) (err error) {
+	// The parent directory must already exist, we don't create it
+	pfi, err := os.Stat(filepath.Dir(filePath))
+	if err != nil || !pfi.IsDir() {
+		http.Error(w, "parent directory does not exist", http.StatusConflict)
+		return nil
+	}
+
+	var existed bool
+	fi, err := os.Stat(filePath)
+	if err == nil {
+		if fi.IsDir() {
+			http.Error(w, "cannot replace a directory with a file", http.StatusConflict)
+			return nil
+		}
+		existed = true
+	}
+
+	err = writeFileAtomic(filePath, r.Body)
+	if err != nil {
+		return
+	}
+
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	return
+}
+
+// postFiles saves all files from a multipart form into the directory dirPath
+func (s *Server) postFiles(dirPath string, w http.ResponseWriter, r *http.Request) (err error) {
+	fi, err := os.Stat(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return nil
+		}
+		return
+	}
+	if !fi.IsDir() {
+		http.Error(w, "files can only be posted to a directory", http.StatusBadRequest)
+		return
+	}
+
+	// Read the form part by part so we don't need to keep everything in memory
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// Ignore anything that is not an uploaded file
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		// FileName already strips any directories from the name, but it might still be something weird
+		name := filepath.Base(part.FileName())
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			part.Close()
+			http.Error(w, "invalid file name", http.StatusBadRequest)
+			return nil
+		}
+
+		err = writeFileAtomic(filepath.Join(dirPath, name), part)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Go back to the directory listing
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+	return nil
+}
+
+// writeFileAtomic writes everything from content to a temporary file and then renames it to filePath.
+// That way nobody will ever see a half-written file
+func writeFileAtomic(filePath string, content io.Reader) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), ".upduck-upload-*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = io.Copy(tmp, content)
+	if err != nil {
+		return
+	}
+
+	// Temporary files are only readable by us, but uploaded files should look like any other file
+	err = tmp.Chmod(0644)
+	if err != nil {
+		return
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), filePath)
+}
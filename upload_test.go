@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	base := filepath.Join(string(filepath.Separator), "srv", "files")
+	s := &Server{BaseDir: base}
+
+	var tests = []struct {
+		urlPath string
+		want    string
+		wantErr error
+	}{
+		{"/", base, nil},
+		{"", base, nil},
+		{"/file.txt", filepath.Join(base, "file.txt"), nil},
+		{"/a/b/file.txt", filepath.Join(base, "a", "b", "file.txt"), nil},
+		{"/a/../file.txt", filepath.Join(base, "file.txt"), nil},
+		{"/a/./file.txt", filepath.Join(base, "a", "file.txt"), nil},
+		{"//a//file.txt", filepath.Join(base, "a", "file.txt"), nil},
+		{"/..file.txt", filepath.Join(base, "..file.txt"), nil},
+		{"/..", "", errOutsideBaseDir},
+		{"/../secret.txt", "", errOutsideBaseDir},
+		{"/a/../../secret.txt", "", errOutsideBaseDir},
+		{"/../files-other/secret.txt", "", errOutsideBaseDir},
+	}
+
+	for _, tt := range tests {
+		got, err := s.resolvePath(tt.urlPath)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("resolvePath(%q) = %q, %v, want %q, %v", tt.urlPath, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPostFilesNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "served")
+	err = os.Mkdir(base, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, _ := loadUsers(filepath.Join(dir, "users.json"))
+	s := &Server{
+		BaseDir:      base,
+		AllowUploads: true,
+		UserStore:    users,
+	}
+
+	var tests = []struct {
+		name     string
+		filename string
+		want     int
+		// saved is where the file should end up relative to the served directory, empty if nowhere
+		saved string
+	}{
+		{"normal name", "file.txt", http.StatusSeeOther, "file.txt"},
+		{"name with spaces", "my file.txt", http.StatusSeeOther, "my file.txt"},
+		{"directory in name", "sub/dir.txt", http.StatusSeeOther, "dir.txt"},
+		{"parent directory in name", "../parent.txt", http.StatusSeeOther, "parent.txt"},
+		{"absolute path", "/etc/absolute.txt", http.StatusSeeOther, "absolute.txt"},
+		{"only dots", "..", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			fw, err := mw.CreateFormFile("file", tt.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte(tt.name))
+			mw.Close()
+
+			r := httptest.NewRequest(http.MethodPost, "/", &body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d", w.Code, tt.want)
+			}
+			if tt.saved == "" {
+				return
+			}
+
+			content, err := ioutil.ReadFile(filepath.Join(base, tt.saved))
+			if err != nil || string(content) != tt.name {
+				t.Errorf("%s contains %q (error %v), want %q", tt.saved, content, err, tt.name)
+			}
+		})
+	}
+
+	// Nothing may be written next to the served directory
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		if fi.Name() != "served" {
+			t.Errorf("upload created %s outside of the served directory", fi.Name())
+		}
+	}
+}
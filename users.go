@@ -1,19 +1,32 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"log"
 	"os"
+	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type UserStore struct {
 	// map[username]data
 	Users map[string]user `json:"users"`
 
-	umut *sync.RWMutex
+	filepath string
+	umut     *sync.RWMutex
+
+	// authCache remembers successful password checks, see authCacheDuration
+	authCache map[string]authCacheEntry
+	authKey   []byte
+	amut      *sync.Mutex
 }
 
 // NeedAuth returns whether authentication is required
@@ -24,28 +37,139 @@ func (u *UserStore) NeedAuth() bool {
 	return len(u.Users) != 0
 }
 
-// IsValidUser returns whether the given username/credentials combination is valid
+// authCacheDuration is how long a successful password check is remembered. WebDAV clients send the password
+// with every request, without cache every single one would need a slow bcrypt comparison
+const authCacheDuration = time.Minute
+
+type authCacheEntry struct {
+	// PasswordHash is the hash of the user at the time of the check, the entry is invalid once it changes
+	PasswordHash string
+	Expires      time.Time
+}
+
+// IsValidUser returns whether the given username/credentials combination is valid.
+// Users that still have an old unsalted password hash get a new one after logging in successfully
 func (u *UserStore) IsValidUser(user, passwd string) bool {
 	u.umut.RLock()
-	defer u.umut.RUnlock()
-
 	usr, ok := u.Users[user]
+	u.umut.RUnlock()
 	if !ok {
+		// Comparing anyway takes as long as for existing users, else response times would show which users exist
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(passwd))
 		return false
 	}
 
-	return constantTimeEquals(usr.PasswordHash, hash(passwd))
+	if !isLegacyHash(usr.PasswordHash) {
+		key := u.authCacheKey(user, passwd)
+		if u.isCached(key, usr.PasswordHash) {
+			return true
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(usr.PasswordHash), []byte(passwd)) != nil {
+			return false
+		}
+
+		u.cache(key, usr.PasswordHash)
+		return true
+	}
+
+	if !constantTimeEquals(usr.PasswordHash, legacyHash(passwd)) {
+		return false
+	}
+
+	err := u.rehash(user, usr.PasswordHash, passwd)
+	if err != nil {
+		log.Printf("[Warning] Could not update password hash for user %q: %s\n", user, err.Error())
+	}
+
+	return true
+}
+
+// authCacheKey returns the key of the auth cache for the given credentials. It is an HMAC with a random key,
+// so the cache doesn't contain anything that could be used for guessing passwords
+func (u *UserStore) authCacheKey(user, passwd string) string {
+	m := hmac.New(sha256.New, u.authKey)
+	m.Write([]byte(user + "\x00" + passwd))
+	return string(m.Sum(nil))
+}
+
+// isCached returns whether the credentials with the given key were valid for passwordHash recently
+func (u *UserStore) isCached(key, passwordHash string) bool {
+	u.amut.Lock()
+	defer u.amut.Unlock()
+
+	e, ok := u.authCache[key]
+	return ok && e.PasswordHash == passwordHash && time.Now().Before(e.Expires)
+}
+
+// cache remembers that the credentials with the given key are valid for passwordHash
+func (u *UserStore) cache(key, passwordHash string) {
+	u.amut.Lock()
+	defer u.amut.Unlock()
+
+	now := time.Now()
+	for k, e := range u.authCache {
+		if now.After(e.Expires) {
+			delete(u.authCache, k)
+		}
+	}
+
+	u.authCache[key] = authCacheEntry{
+		PasswordHash: passwordHash,
+		Expires:      now.Add(authCacheDuration),
+	}
+}
+
+var (
+	dummyHashOnce  sync.Once
+	dummyHashValue []byte
+)
+
+// dummyHash returns a bcrypt hash that is compared for users that don't exist
+func dummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		var err error
+		dummyHashValue, err = bcrypt.GenerateFromPassword([]byte("upduck"), bcrypt.DefaultCost)
+		if err != nil {
+			panic(err)
+		}
+	})
+	return dummyHashValue
+}
+
+// rehash replaces the legacy password hash oldHash of the given user with a new one
+func (u *UserStore) rehash(name, oldHash, passwd string) (err error) {
+	newHash, err := hashPassword(passwd)
+	if err != nil {
+		return
+	}
+
+	u.umut.Lock()
+	usr, ok := u.Users[name]
+	// Another request might have been faster
+	if !ok || usr.PasswordHash != oldHash {
+		u.umut.Unlock()
+		return nil
+	}
+	usr.PasswordHash = newHash
+	u.Users[name] = usr
+	u.umut.Unlock()
+
+	log.Printf("Upgraded password hash for user %q\n", name)
+
+	return u.Save()
 }
 
 // Save persists the current user data to disk
 func (u *UserStore) Save() (err error) {
-	filepath := getConfigPath(userFileName)
+	filepath := u.filepath
 
 	u.umut.Lock()
 	defer u.umut.Unlock()
 
+	// The file contains password hashes and TOTP secrets, so only we may read it
 	tmp := filepath + ".temp"
-	f, err := os.Create(tmp)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return
 	}
@@ -68,8 +192,18 @@ func (u *UserStore) Save() (err error) {
 func loadUsers(filepath string) (u *UserStore, err error) {
 	// in case of error we must return an empty UserStore, not nil
 	u = &UserStore{
-		Users: make(map[string]user),
-		umut:  new(sync.RWMutex),
+		Users:    make(map[string]user),
+		filepath: filepath,
+		umut:     new(sync.RWMutex),
+
+		authCache: make(map[string]authCacheEntry),
+		authKey:   make([]byte, 32),
+		amut:      new(sync.Mutex),
+	}
+
+	_, err = rand.Read(u.authKey)
+	if err != nil {
+		return
 	}
 
 	f, err := os.Open(filepath)
@@ -89,9 +223,42 @@ func loadUsers(filepath string) (u *UserStore, err error) {
 
 type user struct {
 	PasswordHash string `json:"password_hash"`
+
+	// Role is one of roleRead, roleUpload or roleAdmin. Empty means roleAdmin
+	Role string `json:"role,omitempty"`
+	// Paths contains all directories this user can access. Empty means everything
+	Paths []string `json:"paths,omitempty"`
+
+	// TOTPSecret is the base32 secret of the authenticator app, users with a secret can only log in using the login form
+	TOTPSecret string `json:"totp_secret,omitempty"`
+	// TOTPStep is the time step of the last code the user logged in with, codes can't be used twice
+	TOTPStep int64 `json:"totp_step,omitempty"`
+
+	// Certificates are the client certificates that can log in as this user
+	Certificates []clientCert `json:"certificates,omitempty"`
+
+	// SessionGeneration is increased when the user logs out, which ends all sessions started before
+	SessionGeneration int `json:"session_generation,omitempty"`
+}
+
+// hashPassword returns a salted bcrypt hash of the given password
+func hashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(h), nil
+}
+
+// isLegacyHash returns whether h was generated by legacyHash instead of hashPassword
+func isLegacyHash(h string) bool {
+	return !strings.HasPrefix(h, "$2")
 }
 
-func hash(password string) string {
+// legacyHash returns the unsalted SHA-256 hash that was used for passwords in older versions.
+// It is only used for checking passwords of users that haven't logged in since then
+func legacyHash(password string) string {
 	h := sha256.New()
 
 	_, err := h.Write([]byte(password))
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLegacyPasswordRehash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "users.json")
+	users, _ := loadUsers(fn)
+	users.Users["alice"] = user{PasswordHash: legacyHash("secret"), Role: roleRead}
+
+	if users.IsValidUser("alice", "wrong") {
+		t.Fatal("wrong password is valid")
+	}
+	if !isLegacyHash(users.Users["alice"].PasswordHash) {
+		t.Fatal("a wrong password replaced the legacy hash")
+	}
+
+	if !users.IsValidUser("alice", "secret") {
+		t.Fatal("correct password is not valid")
+	}
+
+	usr := users.Users["alice"]
+	if !strings.HasPrefix(usr.PasswordHash, "$2") || isLegacyHash(usr.PasswordHash) {
+		t.Errorf("password hash %q is not a bcrypt hash after logging in", usr.PasswordHash)
+	}
+	if usr.Role != roleRead {
+		t.Errorf("rehashing changed the role to %q", usr.Role)
+	}
+
+	// The new hash must be saved and still accept the password
+	reloaded, err := loadUsers(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Users["alice"].PasswordHash != usr.PasswordHash {
+		t.Error("the new password hash was not saved")
+	}
+	if !reloaded.IsValidUser("alice", "secret") || reloaded.IsValidUser("alice", "wrong") {
+		t.Error("the new password hash doesn't check passwords correctly")
+	}
+}
+
+func TestIsValidUser(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, _ := loadUsers(filepath.Join("testdata", "does-not-exist.json"))
+	users.Users["alice"] = user{PasswordHash: hash}
+
+	var tests = []struct {
+		user   string
+		passwd string
+		want   bool
+	}{
+		{"alice", "secret", true},
+		// The second check comes from the cache
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"bob", "secret", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := users.IsValidUser(tt.user, tt.passwd); got != tt.want {
+			t.Errorf("IsValidUser(%q, %q) = %v, want %v", tt.user, tt.passwd, got, tt.want)
+		}
+	}
+
+	// Changing the password must not leave the old one in the cache
+	other, err := hashPassword("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.Users["alice"] = user{PasswordHash: other}
+	if users.IsValidUser("alice", "secret") {
+		t.Error("old password is still valid after changing it")
+	}
+}
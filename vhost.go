@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// HostConfig configures how requests for a certain host name are served
+type HostConfig struct {
+	Dir                       string `json:"dir"`
+	DisallowDirectoryListings bool   `json:"disallow_listings"`
+
+	// UserFile is the path of a separate user file for this host. Relative paths are in the configuration directory.
+	// If it is empty, the default users are used
+	UserFile string `json:"user_file,omitempty"`
+}
+
+// HostRouter dispatches requests to different handlers depending on their Host header
+type HostRouter struct {
+	// map[normalized host name]handler
+	Hosts map[string]http.Handler
+
+	// Default handles all requests for unknown hosts
+	Default http.Handler
+}
+
+func (h *HostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := h.Hosts[normalizeHost(r.Host)]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	h.Default.ServeHTTP(w, r)
+}
+
+// normalizeHost removes the port and any trailing dot from a host name, e.g. "Example.com.:8080" => "example.com"
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// ForHost returns a copy of s that serves files according to hc
+func (s *Server) ForHost(hc HostConfig) (hs *Server, err error) {
+	abs, err := checkDir(hc.Dir)
+	if err != nil {
+		return
+	}
+
+	copied := *s
+	hs = &copied
+
+	hs.BaseDir = abs
+	hs.DisallowDirectories = hc.DisallowDirectoryListings
+
+	if s.ShareKey != nil {
+		hs.ShareKey = hostSigningKey(s.ShareKey, abs)
+	}
+
+	if s.WebDAV != nil {
+		hs.WebDAV = newWebDAVHandler(abs)
+	}
+
+	if hc.UserFile != "" {
+		// A missing file would make the host public, which is most likely not what was intended
+		fn := userFilePath(hc.UserFile)
+		hs.UserStore, err = loadUsers(fn)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("user file %q doesn't exist, create it with \"upduck adduser <username> <password> -users %s\"", fn, hc.UserFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !hs.UserStore.NeedAuth() {
+			log.Printf("[Warning] User file %q has no users, everyone can access %s\n", fn, abs)
+		}
+	} else {
+		// The paths of the normal users are relative to the main directory, e.g. a user restricted to /a
+		// may only access /a on a subdomain serving the a directory
+		rel, rerr := filepath.Rel(s.BaseDir, abs)
+		if rerr != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			hs.UserRoot = ""
+			hs.outsideUserRoot = true
+		} else {
+			hs.UserRoot = path.Join("/", s.UserRoot, filepath.ToSlash(rel))
+		}
+	}
+
+	return
+}
+
+// userFilePath returns the path of a user file, relative paths are in the configuration directory
+func userFilePath(fn string) string {
+	if filepath.IsAbs(fn) {
+		return fn
+	}
+	return getConfigPath(fn)
+}
+
+// hostSigningKey returns the key for share links and session cookies of a host that serves baseDir.
+// Links only contain a path, with a shared key a link for /a would also open /a on every other host
+func hostSigningKey(key []byte, baseDir string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("host\n" + baseDir))
+	return m.Sum(nil)
+}
+
+// hostDir returns the directory that is served for host, which must be a virtual host or subdomain from c
+func hostDir(c Config, host string) (dir string, err error) {
+	host = normalizeHost(host)
+
+	for name, hc := range c.Hosts {
+		if normalizeHost(name) == host {
+			return hc.Dir, nil
+		}
+	}
+
+	if i := strings.Index(host, "."); i > 0 {
+		if sub, ok := c.Subdomains[host[:i]]; ok {
+			if !filepath.IsAbs(sub) {
+				sub = filepath.Join(c.BaseDir, sub)
+			}
+			return sub, nil
+		}
+	}
+
+	return "", fmt.Errorf("%q is neither a virtual host nor a subdomain in your configuration", host)
+}
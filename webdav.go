@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"golang.org/x/net/webdav"
+)
+
+// newWebDAVHandler returns a handler that allows WebDAV clients (e.g. file managers) to mount dir as a network drive
+func newWebDAVHandler(dir string) *webdav.Handler {
+	return &webdav.Handler{
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("Error handling WebDAV %s %s from %s: %s\n", r.Method, loggedURL(r), r.RemoteAddr, err.Error())
+			}
+		},
+	}
+}
+
+// isWebDAVRequest returns whether a request should be handled by the WebDAV handler instead of Server.Handler.
+// Browsers only send GET requests (and POST for the upload form), everything else comes from WebDAV clients
+func isWebDAVRequest(r *http.Request) bool {
+	return r.Method != http.MethodGet && r.Method != http.MethodPost
+}
+
+// listsDirectory returns whether r is a WebDAV request that returns the contents of a directory.
+// A PROPFIND request without Depth header means infinite depth
+func listsDirectory(r *http.Request) bool {
+	return r.Method == "PROPFIND" && r.Header.Get("Depth") != "0"
+}
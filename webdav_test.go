@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebDAVDisallowDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upduck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("some content"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, _ := loadUsers(filepath.Join(dir, "users.json"))
+	s := &Server{
+		BaseDir:             dir,
+		DisallowDirectories: true,
+		WebDAV:              newWebDAVHandler(dir),
+		UserStore:           users,
+	}
+
+	var tests = []struct {
+		name  string
+		path  string
+		depth string
+		want  int
+	}{
+		{"directory without depth", "/", "", http.StatusForbidden},
+		{"directory with depth 1", "/", "1", http.StatusForbidden},
+		{"directory with infinite depth", "/", "infinity", http.StatusForbidden},
+		{"directory with depth 0", "/", "0", http.StatusMultiStatus},
+		{"file with depth 0", "/file.txt", "0", http.StatusMultiStatus},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PROPFIND", tt.path, nil)
+			if tt.depth != "" {
+				r.Header.Set("Depth", tt.depth)
+			}
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}